@@ -0,0 +1,308 @@
+package cabri
+
+import (
+	"fmt"
+	"net/http"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	changesDefaultWait = 30 * time.Second
+	changesMaxWait     = 5 * time.Minute
+	changesKeepAlive   = 15 * time.Second
+	changesDedupWindow = 2 * time.Second
+)
+
+// Change is an entry of the journal, Path being the URL path of the resource
+// and Cursor the position following the change
+type Change struct {
+	Cursor string    `json:"cursor"`
+	Time   time.Time `json:"time"`
+	Op     string    `json:"op"`
+	Path   string    `json:"path"`
+	Origin string    `json:"origin"`
+}
+
+// journal keeps the last changes in memory, a cursor "epoch.seq" designating the change numbered seq
+// since the server start, so that the cursors of a previous run are rejected
+type journal struct {
+	mu      sync.Mutex
+	epoch   string
+	first   uint64
+	changes []Change
+	size    int
+	notify  chan struct{}
+	done    chan struct{}
+	recent  map[string]recentChange
+	rmdirs  map[string]*removal
+}
+
+// recentChange is the last change of a path, waiting for the same change notified by another origin
+type recentChange struct {
+	origin string
+	time   time.Time
+}
+
+// removal is a recursive removal of a directory through cabri, whose entries notified by the filesystem
+// are not recorded as the removal of the directory is
+type removal struct {
+	running int
+	end     time.Time
+}
+
+var changeJournal *journal
+
+func initJournal(size int) {
+	if size <= 0 {
+		return
+	}
+	changeJournal = &journal{
+		epoch:  strconv.FormatInt(time.Now().UnixNano(), 36),
+		size:   size,
+		notify: make(chan struct{}),
+		done:   make(chan struct{}),
+		recent: make(map[string]recentChange),
+		rmdirs: make(map[string]*removal),
+	}
+}
+
+// journalPath returns the URL path of the resource at rscPath, cleaned as the paths notified by the filesystem
+func journalPath(rscPath string) string {
+	p := path.Join("/", ActiveRscRoot, rscPath)
+	if strings.HasSuffix(rscPath, "/") && p != "/" {
+		p += "/"
+	}
+	return p
+}
+
+func (j *journal) cursor(seq uint64) string {
+	return fmt.Sprintf("%s.%d", j.epoch, seq)
+}
+
+// record appends a change, unless it is the same change of the same path just recorded from another origin,
+// as a change made through cabri is also notified by the filesystem
+func (j *journal) record(op string, path string, origin string) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	now := time.Now()
+	if origin == "fsnotify" && (op == "delete" || op == "rmdir") && j.removed(path, now) {
+		return
+	}
+	key := op + " " + path
+	if rc, exists := j.recent[key]; exists && rc.origin != origin && now.Sub(rc.time) < changesDedupWindow {
+		delete(j.recent, key)
+		return
+	}
+	j.recent[key] = recentChange{origin: origin, time: now}
+	if len(j.recent) > 1024 {
+		for k, rc := range j.recent {
+			if now.Sub(rc.time) >= changesDedupWindow {
+				delete(j.recent, k)
+			}
+		}
+	}
+	seq := j.first + uint64(len(j.changes))
+	j.changes = append(j.changes, Change{
+		Cursor: j.cursor(seq + 1),
+		Time:   now,
+		Op:     op,
+		Path:   path,
+		Origin: origin,
+	})
+	if len(j.changes) > j.size {
+		drop := len(j.changes) - j.size
+		j.changes = append([]Change(nil), j.changes[drop:]...)
+		j.first += uint64(drop)
+	}
+	close(j.notify)
+	j.notify = make(chan struct{})
+}
+
+// startRemoval must be called before removing recursively the directory at dir, a journal path,
+// and endRemoval once done
+func (j *journal) startRemoval(dir string) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	r, exists := j.rmdirs[dir]
+	if !exists {
+		r = &removal{}
+		j.rmdirs[dir] = r
+	}
+	r.running++
+}
+
+func (j *journal) endRemoval(dir string) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	if r, exists := j.rmdirs[dir]; exists {
+		r.running--
+		r.end = time.Now()
+	}
+}
+
+// removed tells whether path is under a directory being removed recursively or just removed
+func (j *journal) removed(path string, now time.Time) bool {
+	found := false
+	for dir, r := range j.rmdirs {
+		if r.running == 0 && now.Sub(r.end) >= changesDedupWindow {
+			delete(j.rmdirs, dir)
+			continue
+		}
+		if strings.HasPrefix(path, dir) && path != dir {
+			found = true
+		}
+	}
+	return found
+}
+
+// read returns the changes following since, the cursor following them
+// and a channel closed on the next change
+func (j *journal) read(since string) (changes []Change, next string, notify chan struct{}, err error) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	last := j.first + uint64(len(j.changes))
+	next = j.cursor(last)
+	notify = j.notify
+	changes = []Change{}
+	if since == "" {
+		return
+	}
+	pe := strings.Split(since, ".")
+	var seq uint64
+	if len(pe) != 2 || pe[0] != j.epoch {
+		err = fmt.Errorf("cursor %s from another server run", since)
+		return
+	}
+	if seq, err = strconv.ParseUint(pe[1], 10, 64); err != nil || seq > last {
+		err = fmt.Errorf("invalid cursor %s", since)
+		return
+	}
+	if seq < j.first {
+		err = fmt.Errorf("cursor %s expired from the journal", since)
+		return
+	}
+	changes = append(changes, j.changes[seq-j.first:]...)
+	return
+}
+
+func (j *journal) close() {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	select {
+	case <-j.done:
+	default:
+		close(j.done)
+	}
+}
+
+// journaled records the successful PUT and DELETE requests
+func journaled(c *gin.Context) {
+	c.Next()
+	if changeJournal == nil || c.Writer.Status() != http.StatusOK {
+		return
+	}
+	path := journalPath(c.Param("rscPath"))
+	var op string
+	switch {
+	case c.Request.Method == http.MethodPut && strings.HasSuffix(path, "/"):
+		op = "mkdir"
+	case c.Request.Method == http.MethodPut:
+		op = "put"
+	case strings.HasSuffix(path, "/"):
+		op = "rmdir"
+	default:
+		op = "delete"
+	}
+	changeJournal.record(op, path, "cabri")
+}
+
+// changes serves the changes following the since cursor, or the Last-Event-ID header,
+// as a Server-Sent Events stream if requested, otherwise as a JSON document
+// waiting for a change at most wait seconds
+func changes(c *gin.Context) {
+	since := c.Query("since")
+	if since == "" {
+		since = c.GetHeader("Last-Event-ID")
+	}
+	if strings.Contains(c.GetHeader("Accept"), "text/event-stream") {
+		changesStream(c, since)
+		return
+	}
+	wait := changesDefaultWait
+	if ws := c.Query("wait"); ws != "" {
+		seconds, err := strconv.Atoi(ws)
+		if err != nil || seconds < 0 {
+			Error(c, fmt.Sprintf("changes wait %s", ws), fmt.Errorf("invalid wait"), http.StatusBadRequest)
+			return
+		}
+		wait = time.Duration(seconds) * time.Second
+	}
+	if wait > changesMaxWait {
+		wait = changesMaxWait
+	}
+	timer := time.NewTimer(wait)
+	defer timer.Stop()
+	for {
+		list, next, notify, err := changeJournal.read(since)
+		if err != nil {
+			reqLog(c).Infof("changes: %v", err)
+			c.JSON(http.StatusGone, gin.H{"error": err.Error(), "cursor": next})
+			return
+		}
+		if len(list) > 0 || since == "" {
+			c.JSON(http.StatusOK, gin.H{"cursor": next, "changes": list})
+			return
+		}
+		select {
+		case <-notify:
+		case <-timer.C:
+			c.JSON(http.StatusOK, gin.H{"cursor": next, "changes": list})
+			return
+		case <-changeJournal.done:
+			c.JSON(http.StatusOK, gin.H{"cursor": next, "changes": list})
+			return
+		case <-c.Request.Context().Done():
+			return
+		}
+	}
+}
+
+// changesStream sends each change as a "change" event, and a "reset" event
+// when the cursor is not available, the client having to crawl the tree again
+func changesStream(c *gin.Context, since string) {
+	w := c.Writer
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+	keepAlive := time.NewTicker(changesKeepAlive)
+	defer keepAlive.Stop()
+	for {
+		list, next, notify, err := changeJournal.read(since)
+		if err != nil {
+			reqLog(c).Infof("changes: %v", err)
+			fmt.Fprintf(w, "id: %s\nevent: reset\ndata: {\"cursor\":%q}\n\n", next, next)
+			list = nil
+		}
+		for _, change := range list {
+			fmt.Fprintf(w, "id: %s\nevent: change\ndata: {\"cursor\":%q,\"time\":%q,\"op\":%q,\"path\":%q,\"origin\":%q}\n\n",
+				change.Cursor, change.Cursor, change.Time.Format(time.RFC3339Nano), change.Op, change.Path, change.Origin)
+		}
+		w.Flush()
+		since = next
+		select {
+		case <-notify:
+		case <-keepAlive.C:
+			fmt.Fprintf(w, ": keep-alive\n\n")
+		case <-changeJournal.done:
+			return
+		case <-c.Request.Context().Done():
+			return
+		}
+	}
+}
@@ -0,0 +1,205 @@
+package cabri
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+func newTestJournal(t *testing.T, size int) *journal {
+	t.Helper()
+	initJournal(size)
+	j := changeJournal
+	t.Cleanup(func() { changeJournal = nil })
+	return j
+}
+
+// changeOps returns the operations and paths of changes
+func changeOps(changes []Change) (ops []string) {
+	for _, change := range changes {
+		ops = append(ops, change.Op+" "+change.Path)
+	}
+	return
+}
+
+func TestJournalRead(t *testing.T) {
+	j := newTestJournal(t, 10)
+	changes, next, _, err := j.read("")
+	if err != nil || len(changes) != 0 || next != j.cursor(0) {
+		t.Fatalf("read from the start: %v %s %v", changes, next, err)
+	}
+	j.record("put", "/r/a", "cabri")
+	j.record("mkdir", "/r/d/", "cabri")
+	j.record("delete", "/r/a", "cabri")
+	if changes, next, _, err = j.read(j.cursor(0)); err != nil || len(changes) != 3 || next != j.cursor(3) {
+		t.Fatalf("read all: %v %s %v", changeOps(changes), next, err)
+	}
+	if changes[2].Cursor != next {
+		t.Errorf("cursor of the last change %s, expected %s", changes[2].Cursor, next)
+	}
+	if changes, _, _, err = j.read(changes[1].Cursor); err != nil || len(changes) != 1 || changes[0].Path != "/r/a" || changes[0].Op != "delete" {
+		t.Errorf("read after the second change: %v %v", changeOps(changes), err)
+	}
+	if changes, _, _, err = j.read(next); err != nil || len(changes) != 0 {
+		t.Errorf("read at the end: %v %v", changeOps(changes), err)
+	}
+}
+
+func TestJournalInvalidCursors(t *testing.T) {
+	j := newTestJournal(t, 2)
+	for _, path := range []string{"/r/a", "/r/b", "/r/c", "/r/d"} {
+		j.record("put", path, "cabri")
+	}
+	tests := []struct {
+		name   string
+		cursor string
+	}{
+		{"other epoch", "otherepoch.1"},
+		{"no sequence", j.epoch},
+		{"invalid sequence", j.epoch + ".x"},
+		{"future", j.cursor(5)},
+		{"evicted", j.cursor(1)},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			changes, next, _, err := j.read(test.cursor)
+			if err == nil {
+				t.Errorf("no error, changes %v", changeOps(changes))
+			}
+			if next != j.cursor(4) {
+				t.Errorf("next cursor %s, expected %s", next, j.cursor(4))
+			}
+		})
+	}
+	changes, _, _, err := j.read(j.cursor(2))
+	if err != nil || len(changes) != 2 || changes[0].Path != "/r/c" {
+		t.Errorf("read from the oldest change kept: %v %v", changeOps(changes), err)
+	}
+}
+
+func TestJournalDuplicates(t *testing.T) {
+	j := newTestJournal(t, 10)
+	// a change made through cabri notified by the filesystem, in both orders
+	j.record("put", "/r/a", "cabri")
+	j.record("put", "/r/a", "fsnotify")
+	j.record("rmdir", "/r/d/", "fsnotify")
+	j.record("rmdir", "/r/d/", "cabri")
+	// the same change twice from the same origin, or another change of the same path
+	j.record("put", "/r/b", "cabri")
+	j.record("put", "/r/b", "cabri")
+	j.record("delete", "/r/b", "fsnotify")
+	// a change notified again once deduplicated
+	j.record("put", "/r/a", "fsnotify")
+	// the same change from another origin out of the deduplication window
+	j.record("put", "/r/c", "cabri")
+	j.mu.Lock()
+	j.recent["put /r/c"] = recentChange{origin: "cabri", time: time.Now().Add(-changesDedupWindow)}
+	j.mu.Unlock()
+	j.record("put", "/r/c", "fsnotify")
+	changes, _, _, err := j.read(j.cursor(0))
+	if err != nil {
+		t.Fatalf("read: %v", err)
+	}
+	expected := []string{"put /r/a", "rmdir /r/d/", "put /r/b", "put /r/b", "delete /r/b", "put /r/a", "put /r/c", "put /r/c"}
+	if ops := changeOps(changes); !reflect.DeepEqual(ops, expected) {
+		t.Fatalf("changes %v, expected %v", ops, expected)
+	}
+	if changes[0].Origin != "cabri" || changes[1].Origin != "fsnotify" {
+		t.Errorf("origins %s %s, expected those of the first notifications", changes[0].Origin, changes[1].Origin)
+	}
+}
+
+func TestJournalNotify(t *testing.T) {
+	j := newTestJournal(t, 10)
+	_, _, notify, _ := j.read("")
+	select {
+	case <-notify:
+		t.Fatalf("notified without change")
+	default:
+	}
+	j.record("put", "/r/a", "cabri")
+	select {
+	case <-notify:
+	default:
+		t.Errorf("not notified of the change")
+	}
+}
+
+func TestChangesStaleCursor(t *testing.T) {
+	j := newTestJournal(t, 1)
+	j.record("put", "/r/a", "cabri")
+	j.record("put", "/r/b", "cabri")
+	gin.SetMode(gin.TestMode)
+	engine := gin.New()
+	engine.GET("/changes", changes)
+	for _, since := range []string{j.cursor(0), "otherepoch.1", j.cursor(3)} {
+		w := httptest.NewRecorder()
+		engine.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/changes?wait=0&since="+since, nil))
+		var body struct {
+			Cursor string `json:"cursor"`
+		}
+		if w.Code != http.StatusGone || json.Unmarshal(w.Body.Bytes(), &body) != nil || body.Cursor != j.cursor(2) {
+			t.Errorf("since %s: status %d body %s, expected 410 with cursor %s", since, w.Code, w.Body.String(), j.cursor(2))
+		}
+	}
+}
+
+func TestJournalPath(t *testing.T) {
+	saved := ActiveRscRoot
+	defer func() { ActiveRscRoot = saved }()
+	tests := []struct {
+		rscRoot string
+		rscPath string
+		path    string
+	}{
+		{"/r", "/a/b", "/r/a/b"},
+		{"/r", "/a/", "/r/a/"},
+		{"/r", "//a//b/", "/r/a/b/"},
+		{"/r", "/./a", "/r/a"},
+		{"/r", "/", "/r/"},
+		{"r", "a", "/r/a"},
+		{"", "a/b", "/a/b"},
+		{"", "/a/", "/a/"},
+		{"", ".", "/"},
+		{"", "/", "/"},
+	}
+	for _, test := range tests {
+		ActiveRscRoot = test.rscRoot
+		if p := journalPath(test.rscPath); p != test.path {
+			t.Errorf("journalPath(%q) under %q = %q, expected %q", test.rscPath, test.rscRoot, p, test.path)
+		}
+	}
+}
+
+func TestJournalRecursiveRemoval(t *testing.T) {
+	j := newTestJournal(t, 10)
+	j.startRemoval("/r/d/")
+	j.record("delete", "/r/d/f", "fsnotify")
+	j.record("rmdir", "/r/d/e/", "fsnotify")
+	j.record("delete", "/r/dd", "fsnotify")
+	j.record("put", "/r/d/g", "fsnotify")
+	j.endRemoval("/r/d/")
+	j.record("delete", "/r/d/e/f", "fsnotify")
+	j.record("rmdir", "/r/d/", "cabri")
+	j.record("rmdir", "/r/d/", "fsnotify")
+	j.mu.Lock()
+	j.rmdirs["/r/d/"].end = time.Now().Add(-changesDedupWindow)
+	j.mu.Unlock()
+	j.record("delete", "/r/d/g", "fsnotify")
+	changes, _, _, err := j.read(j.cursor(0))
+	if err != nil {
+		t.Fatalf("read: %v", err)
+	}
+	expected := []string{"delete /r/dd", "put /r/d/g", "rmdir /r/d/", "delete /r/d/g"}
+	if ops := changeOps(changes); !reflect.DeepEqual(ops, expected) {
+		t.Errorf("changes %v, expected %v", ops, expected)
+	}
+	if len(j.rmdirs) != 0 {
+		t.Errorf("removals %v kept after the deduplication window", j.rmdirs)
+	}
+}
@@ -0,0 +1,71 @@
+package client
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// Change is a change of the journal of the server, Path being relative to the base URL
+type Change struct {
+	Cursor string    `json:"cursor"`
+	Time   time.Time `json:"time"`
+	Op     string    `json:"op"`
+	Path   string    `json:"path"`
+	Origin string    `json:"origin"`
+}
+
+type changesResponse struct {
+	Cursor  string   `json:"cursor"`
+	Changes []Change `json:"changes"`
+	Error   string   `json:"error"`
+}
+
+// Changes returns the changes under the base URL following the since cursor,
+// waiting for them at most wait, and the cursor to use for the next call,
+// the current cursor with no change if since is empty.
+// The error matches ErrGone if the changes following since are not available anymore,
+// the returned cursor being the current one, the tree needing to be crawled again
+func (c *Client) Changes(ctx context.Context, since string, wait time.Duration) (changes []Change, cursor string, err error) {
+	var u *url.URL
+	if u, err = url.Parse(c.baseUrl); err != nil {
+		return nil, "", err
+	}
+	basePath := u.Path
+	query := url.Values{}
+	if since != "" {
+		query.Set("since", since)
+	}
+	query.Set("wait", fmt.Sprintf("%d", int(wait/time.Second)))
+	changesUrl := fmt.Sprintf("%s://%s/changes?%s", u.Scheme, u.Host, query.Encode())
+	resp, err := c.do(ctx, http.MethodGet, changesUrl, nil)
+	if err != nil {
+		return nil, "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusGone {
+		return nil, "", newStatusError(resp)
+	}
+	var cr changesResponse
+	if err = json.NewDecoder(resp.Body).Decode(&cr); err != nil {
+		return nil, "", fmt.Errorf("changes %s: %v", changesUrl, err)
+	}
+	if resp.StatusCode == http.StatusGone {
+		return nil, cr.Cursor, &StatusError{Method: http.MethodGet, Url: changesUrl, Status: resp.StatusCode, Message: cr.Error}
+	}
+	for _, change := range cr.Changes {
+		if change.Path != basePath && !strings.HasPrefix(change.Path, basePath+"/") {
+			continue
+		}
+		change.Path = change.Path[len(basePath):]
+		if change.Path == "" {
+			change.Path = "/"
+		}
+		changes = append(changes, change)
+	}
+	return changes, cr.Cursor, nil
+}
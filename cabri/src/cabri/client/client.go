@@ -0,0 +1,260 @@
+package client
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const TimeFormat = "Mon, 02 Jan 2006 15:04:05 GMT"
+
+// Client speaks the cabri protocol with the server serving baseUrl,
+// such as http://cabri_server:8080/s3cabri/a_bucket, paths being relative to it
+// and ending with "/" for directories, the first segment of its path being the root URL of the server
+type Client struct {
+	baseUrl    string
+	prefix     string
+	httpClient *http.Client
+}
+
+type Info struct {
+	Path         string
+	IsDir        bool
+	Size         int64
+	LastModified time.Time
+	Checksum     string
+}
+
+// New returns a client using httpClient, http.DefaultClient if nil
+func New(baseUrl string, httpClient *http.Client) *Client {
+	baseUrl = strings.TrimRight(baseUrl, "/")
+	if httpClient == nil {
+		httpClient = http.DefaultClient
+	}
+	return &Client{
+		baseUrl:    baseUrl,
+		prefix:     listPrefix(baseUrl),
+		httpClient: httpClient,
+	}
+}
+
+// listPrefix returns the path of baseUrl relative to the root URL of the server,
+// which starts the entries listed, such as /a_bucket for http://cabri_server:8080/s3cabri/a_bucket
+// or the empty string for http://cabri_server:8181/fscabri
+func listPrefix(baseUrl string) string {
+	u, err := url.Parse(baseUrl)
+	if err != nil {
+		return ""
+	}
+	segments := strings.SplitN(strings.Trim(u.Path, "/"), "/", 2)
+	if len(segments) < 2 {
+		return ""
+	}
+	return "/" + segments[1]
+}
+
+func (c *Client) BaseUrl() string {
+	return c.baseUrl
+}
+
+func (c *Client) Url(path string) string {
+	return fmt.Sprintf("%s%s", c.baseUrl, path)
+}
+
+func (c *Client) do(ctx context.Context, method string, url string, body io.Reader) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, method, url, body)
+	if err != nil {
+		return nil, err
+	}
+	return c.httpClient.Do(req)
+}
+
+func infoFromHeader(path string, header http.Header) *Info {
+	info := &Info{
+		Path:     path,
+		IsDir:    strings.HasSuffix(path, "/"),
+		Size:     -1,
+		Checksum: header.Get("Checksum"),
+	}
+	if size, err := strconv.ParseInt(header.Get("Content-Length"), 10, 64); err == nil && !info.IsDir {
+		info.Size = size
+	}
+	if t, err := http.ParseTime(header.Get("Last-Modified")); err == nil {
+		info.LastModified = t
+	}
+	return info
+}
+
+// Stat returns the information of a file or a directory, an error matching ErrNotFound if absent
+func (c *Client) Stat(ctx context.Context, path string) (*Info, error) {
+	resp, err := c.do(ctx, http.MethodHead, c.Url(path), nil)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, newStatusError(resp)
+	}
+	return infoFromHeader(path, resp.Header), nil
+}
+
+// List returns the paths of the entries of a directory, directories first
+func (c *Client) List(ctx context.Context, path string) (entries []string, err error) {
+	var infos []*Info
+	if infos, err = c.list(ctx, path, false); err != nil {
+		return
+	}
+	for _, info := range infos {
+		entries = append(entries, info.Path)
+	}
+	return
+}
+
+// ListInfo returns the entries of a directory with their size and modification time,
+// -1 and the zero time when unknown, their checksum being unknown
+func (c *Client) ListInfo(ctx context.Context, path string) ([]*Info, error) {
+	return c.list(ctx, path, true)
+}
+
+func (c *Client) list(ctx context.Context, path string, meta bool) (infos []*Info, err error) {
+	listUrl := c.Url(path)
+	if meta {
+		listUrl += "?meta"
+	}
+	var resp *http.Response
+	if resp, err = c.do(ctx, http.MethodGet, listUrl, nil); err != nil {
+		return
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, newStatusError(resp)
+	}
+	rd := bufio.NewReader(resp.Body)
+	for {
+		var line string
+		line, err = rd.ReadString('\n')
+		if line == "\n" {
+			return infos, nil
+		}
+		if err == io.EOF {
+			return nil, fmt.Errorf("list %s: truncated listing", c.Url(path))
+		}
+		if err != nil {
+			return nil, err
+		}
+		if !strings.HasPrefix(line, c.prefix+path) || len(line) < len(c.prefix)+len(path)+2 {
+			return nil, fmt.Errorf("list %s: unexpected entry %q", c.Url(path), line)
+		}
+		infos = append(infos, parseListEntry(line[len(c.prefix):len(line)-1]))
+	}
+}
+
+// parseListEntry parses "path" or "path\tsize\tlast-modified", "-" standing for an unknown value
+func parseListEntry(line string) *Info {
+	fields := strings.Split(line, "\t")
+	info := &Info{
+		Path:  fields[0],
+		IsDir: strings.HasSuffix(fields[0], "/"),
+		Size:  -1,
+	}
+	if len(fields) == 3 {
+		if size, err := strconv.ParseInt(fields[1], 10, 64); err == nil {
+			info.Size = size
+		}
+		if t, err := http.ParseTime(fields[2]); err == nil {
+			info.LastModified = t
+		}
+	}
+	return info
+}
+
+// Get returns the content of a file with its information, the caller closing the content
+func (c *Client) Get(ctx context.Context, path string) (io.ReadCloser, *Info, error) {
+	resp, err := c.do(ctx, http.MethodGet, c.Url(path), nil)
+	if err != nil {
+		return nil, nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		defer resp.Body.Close()
+		return nil, nil, newStatusError(resp)
+	}
+	info := infoFromHeader(path, resp.Header)
+	info.Size = resp.ContentLength
+	return resp.Body, info, nil
+}
+
+// Put writes the content of a file, size being -1 if unknown and a zero lastModified meaning now,
+// and returns the checksum computed by the server
+func (c *Client) Put(ctx context.Context, path string, content io.Reader, size int64, lastModified time.Time) (checksum string, err error) {
+	if lastModified.IsZero() {
+		lastModified = time.Now()
+	}
+	var req *http.Request
+	if req, err = http.NewRequestWithContext(ctx, http.MethodPut, c.Url(path), content); err != nil {
+		return
+	}
+	req.ContentLength = size
+	if size == 0 {
+		req.Body = http.NoBody
+	}
+	req.Header.Set("Last-Modified", lastModified.UTC().Format(TimeFormat))
+	var resp *http.Response
+	if resp, err = c.httpClient.Do(req); err != nil {
+		return
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", newStatusError(resp)
+	}
+	return resp.Header.Get("Checksum"), nil
+}
+
+// Mkdir creates a directory with its missing parents
+func (c *Client) Mkdir(ctx context.Context, path string) error {
+	return c.MkdirTime(ctx, path, time.Time{})
+}
+
+// MkdirTime creates a directory with its missing parents if needed
+// and sets its modification time unless lastModified is zero
+func (c *Client) MkdirTime(ctx context.Context, path string, lastModified time.Time) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPut, c.Url(path)+"?recursive", strings.NewReader(""))
+	if err != nil {
+		return err
+	}
+	if !lastModified.IsZero() {
+		req.Header.Set("Last-Modified", lastModified.UTC().Format(TimeFormat))
+	}
+	resp, err := c.httpClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return newStatusError(resp)
+	}
+	return nil
+}
+
+// Delete removes a file, or a directory with its content if recursive,
+// a non-empty directory otherwise failing with an error matching ErrConflict
+func (c *Client) Delete(ctx context.Context, path string, recursive bool) error {
+	deleteUrl := c.Url(path)
+	if recursive && strings.HasSuffix(path, "/") {
+		deleteUrl += "?recursive"
+	}
+	resp, err := c.do(ctx, http.MethodDelete, deleteUrl, nil)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return newStatusError(resp)
+	}
+	return nil
+}
@@ -0,0 +1,101 @@
+package client
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// newListServer serves the listings of a server mounted on rscRoot,
+// the entries being relative to rscRoot as in a cabri server
+func newListServer(t *testing.T, rscRoot string) *httptest.Server {
+	t.Helper()
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		rscPath := strings.TrimPrefix(r.URL.Path, rscRoot)
+		if rscPath == r.URL.Path || !strings.HasSuffix(rscPath, "/") {
+			http.NotFound(w, r)
+			return
+		}
+		_, meta := r.URL.Query()["meta"]
+		for _, entry := range []string{rscPath + "d/", rscPath + "f"} {
+			if meta {
+				fmt.Fprintf(w, "%s\t3\tMon, 19 Oct 2026 12:00:00 GMT\n", entry)
+			} else {
+				fmt.Fprintf(w, "%s\n", entry)
+			}
+		}
+		fmt.Fprintf(w, "\n")
+	}))
+	t.Cleanup(server.Close)
+	return server
+}
+
+func TestList(t *testing.T) {
+	tests := []struct {
+		name    string
+		rscRoot string
+		base    string
+		path    string
+	}{
+		{"fs root", "/fscabri", "/fscabri", "/"},
+		{"fs root with a trailing slash", "/fscabri", "/fscabri/", "/"},
+		{"fs root subdirectory", "/fscabri", "/fscabri", "/fscabri/"},
+		{"fs nested", "/fscabri", "/fscabri/a/b", "/"},
+		{"fs nested subdirectory", "/fscabri", "/fscabri/a/b", "/a/b/"},
+		{"s3 bucket", "/s3cabri", "/s3cabri/a_bucket", "/"},
+		{"s3 bucket subdirectory", "/s3cabri", "/s3cabri/a_bucket", "/c/"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			server := newListServer(t, test.rscRoot)
+			c := New(server.URL+test.base, nil)
+			expected := []string{test.path + "d/", test.path + "f"}
+			entries, err := c.List(context.Background(), test.path)
+			if err != nil {
+				t.Fatalf("List: %v", err)
+			}
+			if !reflect.DeepEqual(entries, expected) {
+				t.Errorf("entries %q, expected %q", entries, expected)
+			}
+			infos, err := c.ListInfo(context.Background(), test.path)
+			if err != nil {
+				t.Fatalf("ListInfo: %v", err)
+			}
+			if len(infos) != 2 || infos[0].Path != expected[0] || !infos[0].IsDir ||
+				infos[1].Path != expected[1] || infos[1].IsDir || infos[1].Size != 3 || infos[1].LastModified.IsZero() {
+				t.Errorf("infos %+v %+v, expected %q", infos[0], infos[1], expected)
+			}
+		})
+	}
+}
+
+func TestListUnexpectedEntry(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintf(w, "/other/f\n\n")
+	}))
+	defer server.Close()
+	if _, err := New(server.URL+"/s3cabri/a_bucket", nil).List(context.Background(), "/"); err == nil {
+		t.Errorf("no error for an entry out of the listed directory")
+	}
+}
+
+func TestListPrefix(t *testing.T) {
+	tests := []struct {
+		baseUrl string
+		prefix  string
+	}{
+		{"http://cabri_server:8181/fscabri", ""},
+		{"http://cabri_server:8181/fscabri/a/b", "/a/b"},
+		{"http://cabri_server:8080/s3cabri/a_bucket", "/a_bucket"},
+		{"http://cabri_server:8080", ""},
+	}
+	for _, test := range tests {
+		if prefix := New(test.baseUrl, nil).prefix; prefix != test.prefix {
+			t.Errorf("prefix of %s %q, expected %q", test.baseUrl, prefix, test.prefix)
+		}
+	}
+}
@@ -0,0 +1,60 @@
+package client
+
+import (
+	"cabri/delta"
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"time"
+)
+
+// Signature returns the delta signature of a file computed with blockSize by the server
+// and the file information, an error matching ErrUnsupported if the server does not support delta transfers
+func (c *Client) Signature(ctx context.Context, path string, blockSize int) (*delta.Signature, *Info, error) {
+	resp, err := c.do(ctx, http.MethodGet, fmt.Sprintf("%s?signature&block=%d", c.Url(path), blockSize), nil)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, nil, newStatusError(resp)
+	}
+	if resp.Header.Get("Content-Type") != delta.ContentType {
+		return nil, nil, fmt.Errorf("signature %s: %w", c.Url(path), ErrUnsupported)
+	}
+	sig, err := delta.ReadSignature(resp.Body)
+	if err != nil {
+		return nil, nil, fmt.Errorf("signature %s: %v", c.Url(path), err)
+	}
+	info := infoFromHeader(path, resp.Header)
+	info.Size = sig.Size
+	return sig, info, nil
+}
+
+// PutPatch writes the content of a file produced by applying patch, a delta encoded with a signature
+// of the file, to the file, failing with status 412 if the file was modified after baseLastModified,
+// and returns the checksum computed by the server
+func (c *Client) PutPatch(ctx context.Context, path string, patch io.Reader, blockSize int, baseLastModified time.Time, lastModified time.Time) (checksum string, err error) {
+	if lastModified.IsZero() {
+		lastModified = time.Now()
+	}
+	var req *http.Request
+	if req, err = http.NewRequestWithContext(ctx, http.MethodPut, fmt.Sprintf("%s?patch&block=%d", c.Url(path), blockSize), patch); err != nil {
+		return
+	}
+	req.ContentLength = -1
+	req.Header.Set("Last-Modified", lastModified.UTC().Format(TimeFormat))
+	if !baseLastModified.IsZero() {
+		req.Header.Set("If-Unmodified-Since", baseLastModified.UTC().Format(TimeFormat))
+	}
+	var resp *http.Response
+	if resp, err = c.httpClient.Do(req); err != nil {
+		return
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", newStatusError(resp)
+	}
+	return resp.Header.Get("Checksum"), nil
+}
@@ -0,0 +1,71 @@
+package client
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"time"
+)
+
+var (
+	ErrNotFound  = errors.New("not found")
+	ErrConflict  = errors.New("conflict")
+	ErrForbidden = errors.New("forbidden")
+	ErrGone      = errors.New("gone")
+	// ErrUnsupported is matched by the errors of requests the server does not support
+	ErrUnsupported = errors.New("unsupported")
+)
+
+// StatusError reports an unexpected status returned by the server,
+// matching ErrNotFound, ErrConflict, ErrForbidden, ErrGone or ErrUnsupported with errors.Is
+type StatusError struct {
+	Method     string
+	Url        string
+	Status     int
+	Message    string
+	RetryAfter time.Duration
+}
+
+func (e *StatusError) Error() string {
+	if e.Message != "" {
+		return fmt.Sprintf("%s %s: status %d: %s", e.Method, e.Url, e.Status, e.Message)
+	}
+	return fmt.Sprintf("%s %s: status %d", e.Method, e.Url, e.Status)
+}
+
+func (e *StatusError) Unwrap() error {
+	switch e.Status {
+	case http.StatusNotFound:
+		return ErrNotFound
+	case http.StatusConflict:
+		return ErrConflict
+	case http.StatusForbidden:
+		return ErrForbidden
+	case http.StatusGone:
+		return ErrGone
+	case http.StatusNotImplemented:
+		return ErrUnsupported
+	}
+	return nil
+}
+
+func newStatusError(resp *http.Response) error {
+	e := &StatusError{Status: resp.StatusCode}
+	if resp.Request != nil {
+		e.Method = resp.Request.Method
+		e.Url = resp.Request.URL.String()
+	}
+	if ra := resp.Header.Get("Retry-After"); ra != "" {
+		var seconds int
+		if _, err := fmt.Sscanf(ra, "%d", &seconds); err == nil {
+			e.RetryAfter = time.Duration(seconds) * time.Second
+		}
+	}
+	if body, err := ioutil.ReadAll(io.LimitReader(resp.Body, 512)); err == nil {
+		e.Message = strings.TrimSpace(string(body))
+	}
+	return e
+}
@@ -1,12 +1,11 @@
 package cabri
 
 import (
+	"context"
 	"fmt"
 	"net/http"
 	"time"
 
-	"github.com/sirupsen/logrus"
-
 	"github.com/gin-gonic/gin"
 )
 
@@ -17,6 +16,9 @@ type ServerConfig struct {
 	ListFunc        gin.HandlerFunc
 	PutContentFunc  gin.HandlerFunc
 	MkdirFunc       gin.HandlerFunc
+	DeleteFunc      gin.HandlerFunc
+	RmdirFunc       gin.HandlerFunc
+	ReadyFunc       func(ctx context.Context) []MountStatus
 }
 
 type StatContent struct {
@@ -33,6 +35,9 @@ var ServerConfigMap = map[string]ServerConfig{
 		ListFunc:        S3List,
 		PutContentFunc:  NotImplementedFunc,
 		MkdirFunc:       NotImplementedFunc,
+		DeleteFunc:      NotImplementedFunc,
+		RmdirFunc:       NotImplementedFunc,
+		ReadyFunc:       S3Ready,
 	},
 	"FSWrite": {
 		GetContentFunc:  FSGetContent,
@@ -41,11 +46,15 @@ var ServerConfigMap = map[string]ServerConfig{
 		ListFunc:        FSList,
 		PutContentFunc:  FSPutContent,
 		MkdirFunc:       FSMkdir,
+		DeleteFunc:      FSDelete,
+		RmdirFunc:       FSRmdir,
+		ReadyFunc:       FSReady,
 	},
 }
 
 func Error(c *gin.Context, msg string, err error, status int) {
-	logrus.Errorf("%s: %v\n", msg, err)
+	reqLog(c).Errorf("%s: %v\n", msg, err)
+	c.Set("cabri.error", fmt.Sprintf("%s: %v", msg, err))
 	if status == 0 {
 		status = http.StatusInternalServerError
 	}
@@ -76,7 +85,15 @@ func MkdirError(c *gin.Context, path string, err error, status int) {
 	Error(c, fmt.Sprintf("mkdir %s", path), err, status)
 }
 
+func DeleteError(c *gin.Context, path string, err error, status int) {
+	Error(c, fmt.Sprintf("delete %s", path), err, status)
+}
+
+func RmdirError(c *gin.Context, path string, err error, status int) {
+	Error(c, fmt.Sprintf("rmdir %s", path), err, status)
+}
+
 func NotImplementedFunc(c *gin.Context) {
-	logrus.Debugf("NotImplementedFunc %s", c.Keys["cabri.rscPath"].(string))
-	Error(c, c.Keys["cabri.rscPath"].(string), fmt.Errorf("not yet implemented"), 0)
+	reqLog(c).Debugf("NotImplementedFunc %s", c.Keys["cabri.rscPath"].(string))
+	Error(c, c.Keys["cabri.rscPath"].(string), fmt.Errorf("not yet implemented"), http.StatusNotImplemented)
 }
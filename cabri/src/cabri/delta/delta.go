@@ -0,0 +1,333 @@
+// Package delta computes rsync-style deltas: the signature of a base content lists
+// the weak rolling checksum and the strong checksum of each of its blocks,
+// a delta encodes a new content as copies of base blocks and literal data
+package delta
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+)
+
+// ContentType is the media type of a signature, telling that a server supports delta transfers
+const ContentType = "application/x-cabri-signature"
+
+const (
+	MinBlockSize = 2048
+	MaxBlockSize = 1 << 20
+	maxBlocks    = 16384
+	maxLiteral   = 1 << 20
+	strongSize   = 16
+
+	opCopy    = 'C'
+	opLiteral = 'D'
+	opEnd     = 'E'
+)
+
+// ErrInvalid is matched by the errors of Apply due to the delta itself
+var ErrInvalid = errors.New("delta: invalid delta")
+
+type Block struct {
+	Weak   uint32
+	Strong [strongSize]byte
+}
+
+type Signature struct {
+	BlockSize int
+	Size      int64
+	Blocks    []Block
+}
+
+// BlockSize returns the block size for a base content of size bytes,
+// growing with the size to bound the number of blocks
+func BlockSize(size int64) int {
+	bs := MinBlockSize
+	for size/int64(bs) > maxBlocks && bs < MaxBlockSize {
+		bs *= 2
+	}
+	return bs
+}
+
+// weak is the rsync rolling checksum of a block
+type weak struct {
+	a, b uint32
+	n    uint32
+}
+
+func newWeak(block []byte) weak {
+	w := weak{n: uint32(len(block))}
+	for i, x := range block {
+		w.a += uint32(x)
+		w.b += uint32(len(block)-i) * uint32(x)
+	}
+	return w
+}
+
+func (w *weak) roll(out byte, in byte) {
+	w.a += uint32(in) - uint32(out)
+	w.b += w.a - w.n*uint32(out)
+}
+
+func (w weak) sum() uint32 {
+	return w.a&0xffff | w.b<<16
+}
+
+func strong(block []byte) (s [strongSize]byte) {
+	h := sha256.Sum256(block)
+	copy(s[:], h[:strongSize])
+	return
+}
+
+// Sign computes the signature of the base content
+func Sign(base io.Reader, blockSize int) (*Signature, error) {
+	sig := &Signature{BlockSize: blockSize}
+	buf := make([]byte, blockSize)
+	for {
+		n, err := io.ReadFull(base, buf)
+		if n > 0 {
+			sig.Blocks = append(sig.Blocks, Block{Weak: newWeak(buf[:n]).sum(), Strong: strong(buf[:n])})
+			sig.Size += int64(n)
+		}
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			return sig, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+}
+
+// WriteSignature writes a "block-size size" line followed by a "weak strong" line for each block,
+// in hexadecimal
+func WriteSignature(w io.Writer, sig *Signature) error {
+	bw := bufio.NewWriter(w)
+	fmt.Fprintf(bw, "%d %d\n", sig.BlockSize, sig.Size)
+	for _, block := range sig.Blocks {
+		fmt.Fprintf(bw, "%08x %x\n", block.Weak, block.Strong)
+	}
+	return bw.Flush()
+}
+
+func ReadSignature(r io.Reader) (*Signature, error) {
+	scanner := bufio.NewScanner(r)
+	if !scanner.Scan() {
+		return nil, fmt.Errorf("delta: empty signature")
+	}
+	sig := &Signature{}
+	if _, err := fmt.Sscanf(scanner.Text(), "%d %d", &sig.BlockSize, &sig.Size); err != nil {
+		return nil, fmt.Errorf("delta: signature header: %v", err)
+	}
+	if sig.BlockSize < 1 || sig.BlockSize > MaxBlockSize || sig.Size < 0 {
+		return nil, fmt.Errorf("delta: invalid signature header %q", scanner.Text())
+	}
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) != 2 || len(fields[1]) != 2*strongSize {
+			return nil, fmt.Errorf("delta: invalid signature block %q", scanner.Text())
+		}
+		var block Block
+		wk, err := strconv.ParseUint(fields[0], 16, 32)
+		if err != nil {
+			return nil, fmt.Errorf("delta: invalid signature block %q", scanner.Text())
+		}
+		block.Weak = uint32(wk)
+		strong, err := hex.DecodeString(fields[1])
+		if err != nil {
+			return nil, fmt.Errorf("delta: invalid signature block %q", scanner.Text())
+		}
+		copy(block.Strong[:], strong)
+		sig.Blocks = append(sig.Blocks, block)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	if expected := (sig.Size + int64(sig.BlockSize) - 1) / int64(sig.BlockSize); int64(len(sig.Blocks)) != expected {
+		return nil, fmt.Errorf("delta: signature with %d blocks instead of %d", len(sig.Blocks), expected)
+	}
+	return sig, nil
+}
+
+// encoder writes the operations, merging the copies of consecutive blocks
+type encoder struct {
+	w         *bufio.Writer
+	runStart  int64
+	runLength uint32
+}
+
+func (e *encoder) flushCopy() {
+	if e.runLength == 0 {
+		return
+	}
+	var op [13]byte
+	op[0] = opCopy
+	binary.BigEndian.PutUint64(op[1:], uint64(e.runStart))
+	binary.BigEndian.PutUint32(op[9:], e.runLength)
+	e.w.Write(op[:])
+	e.runLength = 0
+}
+
+func (e *encoder) copyBlock(index int) {
+	if e.runLength > 0 && e.runStart+int64(e.runLength) == int64(index) {
+		e.runLength++
+		return
+	}
+	e.flushCopy()
+	e.runStart, e.runLength = int64(index), 1
+}
+
+func (e *encoder) literal(data []byte) {
+	if len(data) == 0 {
+		return
+	}
+	e.flushCopy()
+	var op [5]byte
+	op[0] = opLiteral
+	binary.BigEndian.PutUint32(op[1:], uint32(len(data)))
+	e.w.Write(op[:])
+	e.w.Write(data)
+}
+
+// Encode writes the delta transforming the base of the signature into the content
+func Encode(w io.Writer, sig *Signature, content io.Reader) error {
+	bs := sig.BlockSize
+	table := make(map[uint32][]int, len(sig.Blocks))
+	for i, block := range sig.Blocks {
+		table[block.Weak] = append(table[block.Weak], i)
+	}
+	lastLength := int(sig.Size - int64(len(sig.Blocks)-1)*int64(bs))
+	match := func(window []byte, wk uint32) int {
+		for _, i := range table[wk] {
+			if i == len(sig.Blocks)-1 && lastLength != len(window) {
+				continue
+			}
+			if strong(window) == sig.Blocks[i].Strong {
+				return i
+			}
+		}
+		return -1
+	}
+
+	e := &encoder{w: bufio.NewWriter(w)}
+	r := bufio.NewReader(content)
+	// data holds the pending literal followed by the window starting at start
+	data := make([]byte, 0, maxLiteral+bs)
+	start := 0
+	fill := func() (bool, error) {
+		data = data[:bs]
+		n, err := io.ReadFull(r, data)
+		data = data[:n]
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			return false, nil
+		}
+		return err == nil, err
+	}
+	full, err := fill()
+	if err != nil {
+		return err
+	}
+	var wk weak
+	if full {
+		wk = newWeak(data)
+	}
+	for full {
+		if i := match(data[start:], wk.sum()); i >= 0 {
+			e.literal(data[:start])
+			e.copyBlock(i)
+			start = 0
+			if full, err = fill(); err != nil {
+				return err
+			}
+			if full {
+				wk = newWeak(data)
+			}
+			continue
+		}
+		in, err := r.ReadByte()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+		wk.roll(data[start], in)
+		data = append(data, in)
+		start++
+		if start >= maxLiteral {
+			e.literal(data[:start])
+			data = append(data[:0], data[start:]...)
+			start = 0
+		}
+	}
+	// the end of the content may match the last base block, shorter than the others
+	if len(sig.Blocks) > 0 && len(data) >= lastLength {
+		tail := data[len(data)-lastLength:]
+		if i := match(tail, newWeak(tail).sum()); i >= 0 {
+			e.literal(data[:len(data)-lastLength])
+			e.copyBlock(i)
+			data = data[:0]
+		}
+	}
+	e.literal(data)
+	e.flushCopy()
+	e.w.WriteByte(opEnd)
+	return e.w.Flush()
+}
+
+// Apply writes the content produced by the delta from the base of size bytes,
+// failing if the delta is truncated or refers to blocks absent from the base
+func Apply(w io.Writer, base io.ReaderAt, size int64, blockSize int, delta io.Reader) error {
+	r := bufio.NewReader(delta)
+	buf := make([]byte, blockSize)
+	var header [12]byte
+	for {
+		op, err := r.ReadByte()
+		if err == io.EOF {
+			return fmt.Errorf("%w: truncated", ErrInvalid)
+		}
+		if err != nil {
+			return err
+		}
+		switch op {
+		case opCopy:
+			if _, err = io.ReadFull(r, header[:12]); err != nil {
+				return fmt.Errorf("%w: truncated", ErrInvalid)
+			}
+			index := int64(binary.BigEndian.Uint64(header[:8]))
+			count := int64(binary.BigEndian.Uint32(header[8:12]))
+			if index < 0 || count > size || (index+count-1)*int64(blockSize) >= size {
+				return fmt.Errorf("%w: blocks %d to %d out of the base", ErrInvalid, index, index+count-1)
+			}
+			for i := index; i < index+count; i++ {
+				n, err := base.ReadAt(buf, i*int64(blockSize))
+				if err != nil && err != io.EOF {
+					return err
+				}
+				if _, err = w.Write(buf[:n]); err != nil {
+					return err
+				}
+			}
+		case opLiteral:
+			if _, err = io.ReadFull(r, header[:4]); err != nil {
+				return fmt.Errorf("%w: truncated", ErrInvalid)
+			}
+			length := int64(binary.BigEndian.Uint32(header[:4]))
+			var n int64
+			if n, err = io.CopyN(w, r, length); err != nil {
+				if n < length && (err == io.EOF || err == io.ErrUnexpectedEOF) {
+					return fmt.Errorf("%w: truncated", ErrInvalid)
+				}
+				return err
+			}
+		case opEnd:
+			return nil
+		default:
+			return fmt.Errorf("%w: operation %q", ErrInvalid, op)
+		}
+	}
+}
@@ -0,0 +1,144 @@
+package delta
+
+import (
+	"bytes"
+	"errors"
+	"math/rand"
+	"testing"
+)
+
+func randomBytes(rnd *rand.Rand, n int) []byte {
+	b := make([]byte, n)
+	rnd.Read(b)
+	return b
+}
+
+func concat(parts ...[]byte) []byte {
+	return bytes.Join(parts, nil)
+}
+
+// roundTrip encodes content against the signature of base, applies the delta to base
+// and returns the delta size
+func roundTrip(t *testing.T, base []byte, content []byte) int {
+	t.Helper()
+	blockSize := BlockSize(int64(len(base)))
+	sig, err := Sign(bytes.NewReader(base), blockSize)
+	if err != nil {
+		t.Fatalf("Sign: %v", err)
+	}
+	if sig.Size != int64(len(base)) {
+		t.Fatalf("signature size %d, expected %d", sig.Size, len(base))
+	}
+	var patch bytes.Buffer
+	if err = Encode(&patch, sig, bytes.NewReader(content)); err != nil {
+		t.Fatalf("Encode: %v", err)
+	}
+	deltaSize := patch.Len()
+	var result bytes.Buffer
+	if err = Apply(&result, bytes.NewReader(base), int64(len(base)), blockSize, &patch); err != nil {
+		t.Fatalf("Apply: %v", err)
+	}
+	if !bytes.Equal(result.Bytes(), content) {
+		t.Fatalf("applied content of %d bytes differs from the %d bytes encoded", result.Len(), len(content))
+	}
+	return deltaSize
+}
+
+func TestRoundTrip(t *testing.T) {
+	rnd := rand.New(rand.NewSource(1))
+	base := randomBytes(rnd, 20*MinBlockSize)
+	short := base[:7*MinBlockSize+123]
+	insert := randomBytes(rnd, 1000)
+	tests := []struct {
+		name     string
+		base     []byte
+		content  []byte
+		maxDelta int
+	}{
+		{"identical", base, base, 1024},
+		{"insertion", base, concat(base[:5*MinBlockSize+17], insert, base[5*MinBlockSize+17:]), 2*MinBlockSize + 2048},
+		{"deletion", base, concat(base[:3*MinBlockSize+5], base[6*MinBlockSize+100:]), 2*MinBlockSize + 1024},
+		{"append", base, concat(base, insert), 2048},
+		{"truncation", base, base[:11*MinBlockSize], 1024},
+		{"short last block", short, short, 1024},
+		{"short last block changed", short, concat(short[:len(short)-10], insert[:10]), MinBlockSize + 1024},
+		{"short last block grown", short, concat(short, insert), MinBlockSize + 2048},
+		{"empty base", []byte{}, insert, len(insert) + 64},
+		{"empty content", base, []byte{}, 64},
+		{"both empty", []byte{}, []byte{}, 64},
+		{"different", base[:4*MinBlockSize], randomBytes(rnd, 4*MinBlockSize), 4*MinBlockSize + 256},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if deltaSize := roundTrip(t, test.base, test.content); deltaSize > test.maxDelta {
+				t.Errorf("delta of %d bytes, expected at most %d", deltaSize, test.maxDelta)
+			}
+		})
+	}
+}
+
+func TestSignatureRoundTrip(t *testing.T) {
+	rnd := rand.New(rand.NewSource(2))
+	base := randomBytes(rnd, 3*MinBlockSize+42)
+	sig, err := Sign(bytes.NewReader(base), MinBlockSize)
+	if err != nil {
+		t.Fatalf("Sign: %v", err)
+	}
+	if len(sig.Blocks) != 4 {
+		t.Fatalf("%d blocks, expected 4", len(sig.Blocks))
+	}
+	var buf bytes.Buffer
+	if err = WriteSignature(&buf, sig); err != nil {
+		t.Fatalf("WriteSignature: %v", err)
+	}
+	read, err := ReadSignature(&buf)
+	if err != nil {
+		t.Fatalf("ReadSignature: %v", err)
+	}
+	if read.BlockSize != sig.BlockSize || read.Size != sig.Size || len(read.Blocks) != len(sig.Blocks) {
+		t.Fatalf("read signature %d/%d/%d, expected %d/%d/%d",
+			read.BlockSize, read.Size, len(read.Blocks), sig.BlockSize, sig.Size, len(sig.Blocks))
+	}
+	for i := range sig.Blocks {
+		if read.Blocks[i] != sig.Blocks[i] {
+			t.Errorf("block %d differs", i)
+		}
+	}
+}
+
+func TestRollingChecksum(t *testing.T) {
+	rnd := rand.New(rand.NewSource(3))
+	data := randomBytes(rnd, 5000)
+	const n = 512
+	w := newWeak(data[:n])
+	for i := 1; i+n <= len(data); i++ {
+		w.roll(data[i-1], data[i+n-1])
+		if expected := newWeak(data[i : i+n]).sum(); w.sum() != expected {
+			t.Fatalf("rolled checksum at %d is %08x, expected %08x", i, w.sum(), expected)
+		}
+	}
+}
+
+func TestApplyInvalid(t *testing.T) {
+	rnd := rand.New(rand.NewSource(4))
+	base := randomBytes(rnd, 4*MinBlockSize)
+	sig, err := Sign(bytes.NewReader(base), MinBlockSize)
+	if err != nil {
+		t.Fatalf("Sign: %v", err)
+	}
+	var patch bytes.Buffer
+	if err = Encode(&patch, sig, bytes.NewReader(concat(base, base))); err != nil {
+		t.Fatalf("Encode: %v", err)
+	}
+	truncated := patch.Bytes()[:patch.Len()-1]
+	err = Apply(&bytes.Buffer{}, bytes.NewReader(base), int64(len(base)), MinBlockSize, bytes.NewReader(truncated))
+	if !errors.Is(err, ErrInvalid) {
+		t.Errorf("truncated delta: error %v, expected ErrInvalid", err)
+	}
+	// the blocks copied are absent from a shorter base
+	shorter := base[:MinBlockSize]
+	err = Apply(&bytes.Buffer{}, bytes.NewReader(shorter), int64(len(shorter)), MinBlockSize, bytes.NewReader(patch.Bytes()))
+	if !errors.Is(err, ErrInvalid) {
+		t.Errorf("delta beyond the base: error %v, expected ErrInvalid", err)
+	}
+}
@@ -1,9 +1,15 @@
 package cabri
 
 import (
+	"context"
+	"errors"
 	"fmt"
-	"log"
+	"net/http"
+	"os"
+	"os/signal"
 	"strings"
+	"syscall"
+	"time"
 
 	"github.com/gin-gonic/gin"
 	"github.com/sirupsen/logrus"
@@ -11,26 +17,100 @@ import (
 
 var ActiveServerConfig ServerConfig
 var ActiveRootDir string
+var ActiveRscRoot string
+var ActiveConfigName string
+var ActiveReadyBuckets []string
 
-func Run(engine *gin.Engine, addr string, configName string, rscRoot string, rootDir string) {
-	logrus.Debugf("Run configName %s rscRoot %s", configName, rscRoot)
+type RunOptions struct {
+	Addr            string
+	ConfigName      string
+	RscRoot         string
+	RootDir         string
+	ReadyBuckets    []string
+	ShutdownTimeout time.Duration
+	Limits          LimitOptions
+	JournalSize     int
+	JournalFSNotify bool
+	TrustedProxies  []string
+}
+
+var ErrShutdownTimeout = errors.New("shutdown timeout, in-flight requests aborted")
+
+func Run(engine *gin.Engine, options RunOptions) error {
+	logrus.Debugf("Run configName %s rscRoot %s", options.ConfigName, options.RscRoot)
 	var ok = true
-	if ActiveServerConfig, ok = ServerConfigMap[configName]; !ok {
-		log.Fatalf("Invalid config name %s", configName)
+	if ActiveServerConfig, ok = ServerConfigMap[options.ConfigName]; !ok {
+		logrus.Fatalf("Invalid config name %s", options.ConfigName)
 	}
-	ActiveRootDir = rootDir
+	ActiveRootDir = options.RootDir
+	ActiveRscRoot = options.RscRoot
+	ActiveConfigName = options.ConfigName
+	ActiveReadyBuckets = options.ReadyBuckets
 	logrus.Debugf("Run ActiveServerConfig %v ActiveRootDir %s", ActiveServerConfig, ActiveRootDir)
+	if err := initTrustedProxies(engine, options.TrustedProxies); err != nil {
+		return err
+	}
+	initLimits(options.Limits)
+	initJournal(options.JournalSize)
 
 	engine.GET("/ping", func(c *gin.Context) {
 		c.JSON(200, gin.H{
 			"message": "pong",
 		})
 	})
+	engine.GET("/healthz", healthz)
+	engine.GET("/readyz", readyz)
+	if changeJournal != nil {
+		engine.GET("/changes", changes)
+		if options.JournalFSNotify && options.ConfigName == "FSWrite" {
+			if err := watchFS(options.RootDir); err != nil {
+				return fmt.Errorf("Run: watching %s: %v", options.RootDir, err)
+			}
+		}
+	}
+
+	engine.GET(fmt.Sprintf("%s/*rscPath", options.RscRoot), limits, getContentOrList)
+	engine.HEAD(fmt.Sprintf("%s/*rscPath", options.RscRoot), limits, statContent)
+	engine.PUT(fmt.Sprintf("%s/*rscPath", options.RscRoot), auditor, journaled, limits, putContentOrMkdir)
+	engine.DELETE(fmt.Sprintf("%s/*rscPath", options.RscRoot), auditor, journaled, limits, deleteContentOrRmdir)
+
+	srv := &http.Server{
+		Addr:    options.Addr,
+		Handler: engine,
+	}
+	if changeJournal != nil {
+		srv.RegisterOnShutdown(changeJournal.close)
+	}
+	sigChan := make(chan os.Signal, 1)
+	signal.Notify(sigChan, syscall.SIGINT, syscall.SIGTERM)
+	defer signal.Stop(sigChan)
+	errChan := make(chan error, 1)
+	go func() {
+		errChan <- srv.ListenAndServe()
+	}()
+	select {
+	case err := <-errChan:
+		return fmt.Errorf("Run: %v", err)
+	case sig := <-sigChan:
+		logrus.Infof("Run: received %v, draining requests for at most %v", sig, options.ShutdownTimeout)
+	}
+	return shutdown(srv, options.ShutdownTimeout)
+}
 
-	engine.GET(fmt.Sprintf("%s/*rscPath", rscRoot), getContentOrList)
-	engine.HEAD(fmt.Sprintf("%s/*rscPath", rscRoot), statContent)
-	engine.PUT(fmt.Sprintf("%s/*rscPath", rscRoot), putContentOrMkdir)
-	engine.Run(addr)
+func shutdown(srv *http.Server, timeout time.Duration) (err error) {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	defer cleanTempFiles()
+	if err = srv.Shutdown(ctx); err != nil {
+		logrus.Errorf("shutdown: %v\n", err)
+		srv.Close()
+		if errors.Is(err, context.DeadlineExceeded) {
+			return ErrShutdownTimeout
+		}
+		return fmt.Errorf("shutdown: %v", err)
+	}
+	logrus.Info("shutdown: all requests drained")
+	return nil
 }
 
 func getContentOrList(c *gin.Context) {
@@ -59,3 +139,12 @@ func putContentOrMkdir(c *gin.Context) {
 		ActiveServerConfig.PutContentFunc(c)
 	}
 }
+
+func deleteContentOrRmdir(c *gin.Context) {
+	c.Set("cabri.rscPath", c.Param("rscPath"))
+	if strings.HasSuffix(c.Param("rscPath"), "/") {
+		ActiveServerConfig.RmdirFunc(c)
+	} else {
+		ActiveServerConfig.DeleteFunc(c)
+	}
+}
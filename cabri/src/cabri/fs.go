@@ -1,26 +1,100 @@
 package cabri
 
 import (
+	"cabri/delta"
+	"cabri/tracing"
+	"context"
+	"crypto/sha256"
+	"errors"
 	"fmt"
 	"io"
-	"log"
+	"io/ioutil"
 	"net/http"
 	"os"
+	"path"
+	"path/filepath"
 	"sort"
 	"strconv"
+	"strings"
+	"syscall"
+	"time"
 
 	"github.com/gin-gonic/gin"
 	"github.com/sirupsen/logrus"
+	"go.opentelemetry.io/otel/attribute"
 )
 
 func FSGetContent(c *gin.Context) {
-	logrus.Debugf("FSGetContent %s", c.Keys["cabri.rscPath"].(string))
+	reqLog(c).Debugf("FSGetContent %s", c.Keys["cabri.rscPath"].(string))
+	if _, ok := c.Request.URL.Query()["signature"]; ok {
+		fsSignature(c, c.Keys["cabri.rscPath"].(string))
+		return
+	}
 	fsGetContent(c, c.Keys["cabri.rscPath"].(string), "")
 }
 
+// blockSizeQuery returns the block query parameter, or the default block size for size bytes
+func blockSizeQuery(c *gin.Context, size int64) (int, error) {
+	bq := c.Query("block")
+	if bq == "" {
+		return delta.BlockSize(size), nil
+	}
+	bs, err := strconv.Atoi(bq)
+	if err != nil || bs < delta.MinBlockSize || bs > delta.MaxBlockSize {
+		return 0, fmt.Errorf("invalid block size %s", bq)
+	}
+	return bs, nil
+}
+
+// fsSignature returns the delta signature of a file, its computation reading the whole file
+// as for a checksum
+func fsSignature(c *gin.Context, rscPath string) {
+	path := fmt.Sprintf("%s%s", ActiveRootDir, rscPath)
+	var err error
+	ctx, span := tracing.Start(c.Request.Context(), "fsSignature", attribute.String("cabri.path", path))
+	defer func() { tracing.End(span, err) }()
+	var f *os.File
+	if f, err = os.Open(path); err != nil {
+		GetContentError(c, path, err, http.StatusNotFound)
+		return
+	}
+	defer f.Close()
+	var info os.FileInfo
+	if info, err = f.Stat(); err != nil {
+		GetContentError(c, path, err, 0)
+		return
+	}
+	if info.IsDir() {
+		GetContentError(c, path, fmt.Errorf("is a directory"), http.StatusNotFound)
+		return
+	}
+	var bs int
+	if bs, err = blockSizeQuery(c, info.Size()); err != nil {
+		GetContentError(c, path, err, http.StatusBadRequest)
+		return
+	}
+	if err = acquireChecksum(ctx); err != nil {
+		GetContentError(c, path, err, http.StatusServiceUnavailable)
+		return
+	}
+	defer releaseChecksum()
+	var sig *delta.Signature
+	if sig, err = delta.Sign(f, bs); err != nil {
+		GetContentError(c, path, err, 0)
+		return
+	}
+	w := c.Writer
+	w.Header().Set("Content-Type", delta.ContentType)
+	SetLastModified(w, info.ModTime())
+	w.WriteHeader(http.StatusOK)
+	if err = delta.WriteSignature(w, sig); err != nil {
+		reqLog(c).Errorf("fsSignature %s: %v", path, err)
+	}
+}
+
 func fsGetContent(c *gin.Context, rscPath string, checksum string) {
 	path := fmt.Sprintf("%s%s", ActiveRootDir, rscPath)
-	logrus.Debugf("fsGetContent %s", path)
+	reqLog(c).Debugf("fsGetContent %s", path)
 	var f *os.File
 	var err error
 	if f, err = os.Open(path); err != nil {
@@ -43,11 +117,11 @@ func fsGetContent(c *gin.Context, rscPath string, checksum string) {
 		return
 	}
 	if checksum == "" {
-		logrus.Debugf("fsGetContent ServeFile on %s", path)
+		reqLog(c).Debugf("fsGetContent ServeFile on %s", path)
 		http.ServeFile(c.Writer, c.Request, path)
 	} else {
 		var cs string
-		if cs, err = GetChecksum(checksum, path); err != nil {
+		if cs, err = GetChecksum(c.Request.Context(), checksum, path); err != nil {
 			Error(c, fmt.Sprintf("fsGetContent path %s", path), err, http.StatusBadRequest)
 			return
 		}
@@ -62,7 +136,7 @@ func fsGetContent(c *gin.Context, rscPath string, checksum string) {
 }
 
 func FSStatContent(c *gin.Context) {
-	logrus.Debugf("FSStatContent %s", c.Keys["cabri.rscPath"].(string))
+	reqLog(c).Debugf("FSStatContent %s", c.Keys["cabri.rscPath"].(string))
 	fsGetContent(c, c.Keys["cabri.rscPath"].(string), "sha256")
 	if _, exists := c.Get("cabri.statContent"); !exists {
 		return
@@ -76,7 +150,7 @@ func FSStatContent(c *gin.Context) {
 }
 
 func FSStatDir(c *gin.Context) {
-	logrus.Debugf("FSStatDir %s", c.Keys["cabri.rscPath"].(string))
+	reqLog(c).Debugf("FSStatDir %s", c.Keys["cabri.rscPath"].(string))
 	path := fmt.Sprintf("%s%s", ActiveRootDir, c.Keys["cabri.rscPath"].(string))
 	var f *os.File
 	var err error
@@ -104,7 +178,7 @@ func FSStatDir(c *gin.Context) {
 func FSList(c *gin.Context) {
 	rscPath := c.Keys["cabri.rscPath"].(string)
 	path := fmt.Sprintf("%s%s", ActiveRootDir, rscPath)
-	logrus.Debugf("FSList %s", path)
+	reqLog(c).Debugf("FSList %s", path)
 	var f *os.File
 	var err error
 	if f, err = os.Open(path); err != nil {
@@ -129,23 +203,27 @@ func FSList(c *gin.Context) {
 	w := c.Writer
 	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
 	w.WriteHeader(http.StatusOK)
-	dNames := make([]string, 0, len(infos))
-	fNames := make([]string, 0, len(infos))
+	dInfos := make([]os.FileInfo, 0, len(infos))
+	fInfos := make([]os.FileInfo, 0, len(infos))
 	for _, info := range infos {
+		if isTempFile(info.Name()) {
+			continue
+		}
 		if info.IsDir() {
-			dNames = append(dNames, info.Name())
+			dInfos = append(dInfos, info)
 		} else {
-			fNames = append(fNames, info.Name())
+			fInfos = append(fInfos, info)
 		}
 	}
-	sort.Strings(dNames)
-	sort.Strings(fNames)
+	sort.Slice(dInfos, func(i, j int) bool { return dInfos[i].Name() < dInfos[j].Name() })
+	sort.Slice(fInfos, func(i, j int) bool { return fInfos[i].Name() < fInfos[j].Name() })
 
-	for _, name := range dNames {
-		fmt.Fprintf(w, "%s%s/\n", rscPath, name)
+	meta := listMeta(c)
+	for _, info := range dInfos {
+		writeListEntry(w, fmt.Sprintf("%s%s/", rscPath, info.Name()), meta, -1, info.ModTime())
 	}
-	for _, name := range fNames {
-		fmt.Fprintf(w, "%s%s\n", rscPath, name)
+	for _, info := range fInfos {
+		writeListEntry(w, fmt.Sprintf("%s%s", rscPath, info.Name()), meta, info.Size(), info.ModTime())
 	}
 	fmt.Fprintf(w, "\n")
 
@@ -154,31 +232,66 @@ func FSList(c *gin.Context) {
 func FSPutContent(c *gin.Context) {
 	rscPath := c.Keys["cabri.rscPath"].(string)
 	path := fmt.Sprintf("%s%s", ActiveRootDir, rscPath)
-	logrus.Debugf("FSPutContent %s", path)
-	var f *os.File
+	reqLog(c).Debugf("FSPutContent %s", path)
+	_, patch := c.Request.URL.Query()["patch"]
+	var base *os.File
+	var baseInfo os.FileInfo
 	var err error
-	if f, err = os.Open(path); err == nil {
-		defer f.Close()
-		var info os.FileInfo
-		if info, err = f.Stat(); err != nil {
+	if base, err = os.Open(path); err == nil {
+		defer base.Close()
+		if baseInfo, err = base.Stat(); err != nil {
 			PutContentError(c, path, fmt.Errorf("cannot Stat"), 0)
 			return
 		}
-		if info.IsDir() {
+		if baseInfo.IsDir() {
 			PutContentError(c, path, fmt.Errorf("is a directory"), http.StatusBadRequest)
 			return
 		}
-		logrus.Debugf("FSPutContent %s already exists", path)
+		reqLog(c).Debugf("FSPutContent %s already exists", path)
+	} else if patch {
+		PutContentError(c, path, fmt.Errorf("no base to patch"), http.StatusNotFound)
+		return
 	} else {
-		logrus.Debugf("FSPutContent %s created", path)
+		reqLog(c).Debugf("FSPutContent %s created", path)
 	}
-	if f, err = os.Create(path); err != nil {
+	var bs int
+	if patch {
+		if bs, err = blockSizeQuery(c, baseInfo.Size()); err != nil {
+			PutContentError(c, path, err, http.StatusBadRequest)
+			return
+		}
+		if t, err := http.ParseTime(c.Request.Header.Get("If-Unmodified-Since")); err == nil && baseInfo.ModTime().Truncate(time.Second).After(t) {
+			PutContentError(c, path, fmt.Errorf("base modified since its signature"), http.StatusPreconditionFailed)
+			return
+		}
+	}
+	var f *os.File
+	if f, err = createTempFile(filepath.Dir(path), tempFilePrefix+"put-*.tmp", 0666); err != nil {
 		PutContentError(c, path, err, 0)
 		return
 	}
-	defer f.Close()
+	defer removeTempFile(f)
+	// keep the permissions of the replaced file
+	if baseInfo != nil {
+		if err = f.Chmod(baseInfo.Mode().Perm()); err != nil {
+			PutContentError(c, path, err, 0)
+			return
+		}
+	}
 	var wln int64
-	if wln, err = io.Copy(f, c.Request.Body); err != nil {
+	h := sha256.New()
+	if patch {
+		cw := &countingWriter{w: io.MultiWriter(f, h)}
+		err = delta.Apply(cw, base, baseInfo.Size(), bs, c.Request.Body)
+		wln = cw.n
+	} else {
+		wln, err = io.Copy(io.MultiWriter(f, h), c.Request.Body)
+	}
+	if errors.Is(err, delta.ErrInvalid) {
+		PutContentError(c, path, err, http.StatusBadRequest)
+		return
+	}
+	if err != nil {
 		PutContentError(c, path, err, 0)
 		return
 	}
@@ -187,15 +300,25 @@ func FSPutContent(c *gin.Context) {
 		PutContentError(c, path, err, http.StatusBadRequest)
 		return
 	}
-	logrus.Debugf("FSPutContent %s copied %d bytes mtime %v", path, wln, t)
-	f.Close()
+	reqLog(c).Debugf("FSPutContent %s copied %d bytes mtime %v", path, wln, t)
+	cs := fmt.Sprintf("%x", h.Sum(nil))
+	setAudit(c, wln, cs)
+	if err = f.Close(); err != nil {
+		PutContentError(c, path, err, 0)
+		return
+	}
 	err = os.Chtimes(f.Name(), t, t)
 	if err != nil {
 		PutContentError(c, path, err, http.StatusBadRequest)
 		return
 	}
+	if err = os.Rename(f.Name(), path); err != nil {
+		PutContentError(c, path, err, 0)
+		return
+	}
 
 	w := c.Writer
+	w.Header().Set("Checksum", cs)
 	w.WriteHeader(http.StatusOK)
 	return
 }
@@ -204,7 +327,7 @@ func FSMkdir(c *gin.Context) {
 	recursive := false
 	rscPath := c.Keys["cabri.rscPath"].(string)
 	path := fmt.Sprintf("%s%s", ActiveRootDir, rscPath)
-	logrus.Debugf("FSMkdir %s", path)
+	reqLog(c).Debugf("FSMkdir %s", path)
 	_, ok := c.Request.URL.Query()["recursive"]
 	if ok {
 		recursive = true
@@ -222,7 +345,7 @@ func FSMkdir(c *gin.Context) {
 			MkdirError(c, path, fmt.Errorf("is not a directory"), http.StatusBadRequest)
 			return
 		}
-		logrus.Debugf("FSMkdir %s already exists", path)
+		reqLog(c).Debugf("FSMkdir %s already exists", path)
 	} else {
 		var err error
 		if recursive {
@@ -234,10 +357,148 @@ func FSMkdir(c *gin.Context) {
 			MkdirError(c, path, err, 0)
 			return
 		}
-		logrus.Debugf("FSMkdir %s created", path)
-		log.Printf("mkdir %s", path)
+		reqLog(c).Debugf("FSMkdir %s created", path)
+		setAudit(c, 0, "")
+	}
+	if lm := c.Request.Header.Get("last-modified"); lm != "" {
+		var t time.Time
+		if t, err = http.ParseTime(lm); err != nil {
+			MkdirError(c, path, err, http.StatusBadRequest)
+			return
+		}
+		if err = os.Chtimes(path, t, t); err != nil {
+			MkdirError(c, path, err, 0)
+			return
+		}
+		reqLog(c).Debugf("FSMkdir %s mtime %v", path, t)
+	}
+	w := c.Writer
+	w.WriteHeader(http.StatusOK)
+	return
+}
+
+// fsDeletePath returns the file path of the resource to delete, rejecting with 400 a path with ".." segments
+// and with 403 a path that resolves to the root directory or out of it
+func fsDeletePath(rscPath string) (string, int, error) {
+	for _, segment := range strings.Split(rscPath, "/") {
+		if segment == ".." {
+			return "", http.StatusBadRequest, fmt.Errorf("invalid path")
+		}
+	}
+	cleaned := path.Clean("/" + rscPath)
+	if cleaned == "/" {
+		return "", http.StatusForbidden, fmt.Errorf("cannot remove the root directory")
+	}
+	root := filepath.Clean(ActiveRootDir)
+	filePath := filepath.Join(root, filepath.FromSlash(cleaned))
+	if rel, err := filepath.Rel(root, filePath); err != nil || rel == "." || strings.HasPrefix(rel, "..") {
+		return "", http.StatusForbidden, fmt.Errorf("out of the root directory")
+	}
+	return filePath, 0, nil
+}
+
+func FSDelete(c *gin.Context) {
+	rscPath := c.Keys["cabri.rscPath"].(string)
+	path, status, err := fsDeletePath(rscPath)
+	if err != nil {
+		DeleteError(c, rscPath, err, status)
+		return
+	}
+	reqLog(c).Debugf("FSDelete %s", path)
+	var info os.FileInfo
+	if info, err = os.Lstat(path); err != nil {
+		DeleteError(c, path, err, http.StatusNotFound)
+		return
+	}
+	if info.IsDir() {
+		DeleteError(c, path, fmt.Errorf("is a directory"), http.StatusBadRequest)
+		return
+	}
+	if err = os.Remove(path); err != nil {
+		DeleteError(c, path, err, 0)
+		return
+	}
+	reqLog(c).Debugf("FSDelete %s deleted", path)
+	setAudit(c, info.Size(), "")
+	w := c.Writer
+	w.WriteHeader(http.StatusOK)
+	return
+}
+
+func FSRmdir(c *gin.Context) {
+	recursive := false
+	rscPath := c.Keys["cabri.rscPath"].(string)
+	path, status, err := fsDeletePath(rscPath)
+	if err != nil {
+		RmdirError(c, rscPath, err, status)
+		return
+	}
+	reqLog(c).Debugf("FSRmdir %s", path)
+	_, ok := c.Request.URL.Query()["recursive"]
+	if ok {
+		recursive = true
+	}
+	var info os.FileInfo
+	if info, err = os.Lstat(path); err != nil {
+		RmdirError(c, path, err, http.StatusNotFound)
+		return
+	}
+	if !info.IsDir() {
+		RmdirError(c, path, fmt.Errorf("is not a directory"), http.StatusBadRequest)
+		return
+	}
+	if recursive {
+		if changeJournal != nil {
+			dir := journalPath(rscPath)
+			changeJournal.startRemoval(dir)
+			defer changeJournal.endRemoval(dir)
+		}
+		err = os.RemoveAll(path)
+	} else {
+		err = os.Remove(path)
+	}
+	if err != nil {
+		if !recursive && errors.Is(err, syscall.ENOTEMPTY) {
+			RmdirError(c, path, err, http.StatusConflict)
+			return
+		}
+		RmdirError(c, path, err, 0)
+		return
 	}
+	reqLog(c).Debugf("FSRmdir %s removed", path)
+	setAudit(c, 0, "")
 	w := c.Writer
 	w.WriteHeader(http.StatusOK)
 	return
 }
+
+func FSReady(ctx context.Context) []MountStatus {
+	logrus.Debugf("FSReady %s", ActiveRootDir)
+	info, err := os.Stat(ActiveRootDir)
+	if err != nil {
+		return []MountStatus{newMountStatus("", err)}
+	}
+	if !info.IsDir() {
+		return []MountStatus{newMountStatus("", fmt.Errorf("%s is not a directory", ActiveRootDir))}
+	}
+	var f *os.File
+	if f, err = ioutil.TempFile(ActiveRootDir, tempFilePrefix+"ready-*.tmp"); err != nil {
+		return []MountStatus{newMountStatus("", err)}
+	}
+	f.Close()
+	if err = os.Remove(f.Name()); err != nil {
+		return []MountStatus{newMountStatus("", err)}
+	}
+	return []MountStatus{newMountStatus("", nil)}
+}
+
+type countingWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (cw *countingWriter) Write(p []byte) (n int, err error) {
+	n, err = cw.w.Write(p)
+	cw.n += int64(n)
+	return
+}
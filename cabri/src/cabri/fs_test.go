@@ -0,0 +1,103 @@
+package cabri
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+)
+
+// newFSDeleteEngine serves DELETE /root/* on a temporary root holding a/b/file, next to an outside file
+func newFSDeleteEngine(t *testing.T) (*gin.Engine, string) {
+	t.Helper()
+	gin.SetMode(gin.TestMode)
+	dir := t.TempDir()
+	root := filepath.Join(dir, "root")
+	if err := os.MkdirAll(filepath.Join(root, "a", "b"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	for _, file := range []string{filepath.Join(root, "a", "b", "file"), filepath.Join(dir, "outside")} {
+		if err := os.WriteFile(file, []byte("content"), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	savedRootDir, savedConfig := ActiveRootDir, ActiveServerConfig
+	t.Cleanup(func() { ActiveRootDir, ActiveServerConfig = savedRootDir, savedConfig })
+	ActiveRootDir = root
+	ActiveServerConfig = ServerConfigMap["FSWrite"]
+	engine := gin.New()
+	engine.DELETE("/root/*rscPath", deleteContentOrRmdir)
+	return engine, dir
+}
+
+func deleteRequest(engine *gin.Engine, urlPath string) int {
+	req := httptest.NewRequest(http.MethodDelete, "/root/?recursive", nil)
+	req.URL.Path = urlPath
+	w := httptest.NewRecorder()
+	engine.ServeHTTP(w, req)
+	return w.Code
+}
+
+func TestFSDeleteGuards(t *testing.T) {
+	tests := []struct {
+		name    string
+		urlPath string
+		status  int
+	}{
+		{"root", "/root/", http.StatusForbidden},
+		{"double slash", "/root//", http.StatusForbidden},
+		{"dot", "/root/./", http.StatusForbidden},
+		{"dot dot in the tree", "/root/a/../", http.StatusBadRequest},
+		{"dot dot out of the tree", "/root/../", http.StatusBadRequest},
+		{"dot dot to an outside file", "/root/a/../../outside", http.StatusBadRequest},
+		{"dot dot after a directory", "/root/a/b/../../../", http.StatusBadRequest},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			engine, dir := newFSDeleteEngine(t)
+			if status := deleteRequest(engine, test.urlPath); status != test.status {
+				t.Errorf("status %d, expected %d", status, test.status)
+			}
+			for _, file := range []string{filepath.Join(dir, "root", "a", "b", "file"), filepath.Join(dir, "outside")} {
+				if _, err := os.Stat(file); err != nil {
+					t.Errorf("%s: %v", file, err)
+				}
+			}
+		})
+	}
+}
+
+func TestFSDeleteEncodedDotDot(t *testing.T) {
+	engine, dir := newFSDeleteEngine(t)
+	req := httptest.NewRequest(http.MethodDelete, "/root/a/%2e%2e/%2e%2e/outside", nil)
+	w := httptest.NewRecorder()
+	engine.ServeHTTP(w, req)
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("status %d, expected %d", w.Code, http.StatusBadRequest)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "outside")); err != nil {
+		t.Errorf("outside file: %v", err)
+	}
+}
+
+func TestFSDeleteInTree(t *testing.T) {
+	engine, dir := newFSDeleteEngine(t)
+	if status := deleteRequest(engine, "/root/a/b/file"); status != http.StatusOK {
+		t.Fatalf("file deletion: status %d", status)
+	}
+	if status := deleteRequest(engine, "/root/a/b/file"); status != http.StatusNotFound {
+		t.Errorf("deleted file deletion: status %d, expected %d", status, http.StatusNotFound)
+	}
+	if status := deleteRequest(engine, "/root//a/"); status != http.StatusOK {
+		t.Fatalf("directory deletion: status %d", status)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "root", "a")); !os.IsNotExist(err) {
+		t.Errorf("directory still present: %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "root")); err != nil {
+		t.Errorf("root directory: %v", err)
+	}
+}
@@ -0,0 +1,114 @@
+package cabri
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/fsnotify/fsnotify"
+	"github.com/sirupsen/logrus"
+)
+
+// fsWatcher records in the journal the changes made to the filesystem without cabri
+type fsWatcher struct {
+	watcher *fsnotify.Watcher
+	dirs    map[string]bool
+}
+
+func watchFS(rootDir string) error {
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return err
+	}
+	fw := &fsWatcher{watcher: watcher, dirs: make(map[string]bool)}
+	if err = fw.addTree(filepath.Clean(rootDir)); err != nil {
+		watcher.Close()
+		return err
+	}
+	go fw.run()
+	return nil
+}
+
+func (fw *fsWatcher) addTree(dir string) error {
+	return filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			if path == dir {
+				return err
+			}
+			logrus.Warnf("watchFS: %v", err)
+			return nil
+		}
+		if !info.IsDir() {
+			return nil
+		}
+		if err = fw.watcher.Add(path); err != nil {
+			return err
+		}
+		fw.dirs[path] = true
+		return nil
+	})
+}
+
+func (fw *fsWatcher) urlPath(path string) string {
+	rel, err := filepath.Rel(filepath.Clean(ActiveRootDir), path)
+	if err != nil {
+		return ""
+	}
+	return journalPath(filepath.ToSlash(rel))
+}
+
+func (fw *fsWatcher) run() {
+	for {
+		select {
+		case event, ok := <-fw.watcher.Events:
+			if !ok {
+				return
+			}
+			fw.handle(event)
+		case err, ok := <-fw.watcher.Errors:
+			if !ok {
+				return
+			}
+			logrus.Warnf("watchFS: %v", err)
+		}
+	}
+}
+
+func (fw *fsWatcher) handle(event fsnotify.Event) {
+	if isTempFile(filepath.Base(event.Name)) {
+		return
+	}
+	path := fw.urlPath(event.Name)
+	if path == "" {
+		return
+	}
+	switch {
+	case event.Op&fsnotify.Create != 0:
+		info, err := os.Lstat(event.Name)
+		if err != nil {
+			return
+		}
+		if info.IsDir() {
+			if err = fw.addTree(event.Name); err != nil {
+				logrus.Warnf("watchFS: %v", err)
+			}
+			changeJournal.record("mkdir", path+"/", "fsnotify")
+			return
+		}
+		changeJournal.record("put", path, "fsnotify")
+	case event.Op&fsnotify.Write != 0:
+		changeJournal.record("put", path, "fsnotify")
+	case event.Op&(fsnotify.Remove|fsnotify.Rename) != 0:
+		if fw.dirs[event.Name] {
+			for dir := range fw.dirs {
+				if dir == event.Name || strings.HasPrefix(dir, event.Name+string(filepath.Separator)) {
+					fw.watcher.Remove(dir)
+					delete(fw.dirs, dir)
+				}
+			}
+			changeJournal.record("rmdir", path+"/", "fsnotify")
+			return
+		}
+		changeJournal.record("delete", path, "fsnotify")
+	}
+}
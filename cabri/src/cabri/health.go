@@ -0,0 +1,56 @@
+package cabri
+
+import (
+	"context"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+const readyTimeout = 5 * time.Second
+
+type MountStatus struct {
+	Mount  string `json:"mount"`
+	Config string `json:"config"`
+	Ready  bool   `json:"ready"`
+	Error  string `json:"error,omitempty"`
+}
+
+func newMountStatus(name string, err error) MountStatus {
+	ms := MountStatus{
+		Mount:  ActiveRscRoot + "/",
+		Config: ActiveConfigName,
+		Ready:  err == nil,
+	}
+	if name != "" {
+		ms.Mount = ActiveRscRoot + "/" + name + "/"
+	}
+	if err != nil {
+		ms.Error = err.Error()
+	}
+	return ms
+}
+
+func healthz(c *gin.Context) {
+	c.JSON(http.StatusOK, gin.H{
+		"status": "alive",
+	})
+}
+
+func readyz(c *gin.Context) {
+	ctx, cancel := context.WithTimeout(c.Request.Context(), readyTimeout)
+	defer cancel()
+	statuses := ActiveServerConfig.ReadyFunc(ctx)
+	status := http.StatusOK
+	for _, ms := range statuses {
+		if !ms.Ready {
+			reqLog(c).Errorf("readyz %s not ready: %s\n", ms.Mount, ms.Error)
+			status = http.StatusServiceUnavailable
+		}
+	}
+	c.JSON(status, gin.H{
+		"ready":  status == http.StatusOK,
+		"mounts": statuses,
+	})
+}
@@ -0,0 +1,188 @@
+package cabri
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"golang.org/x/time/rate"
+)
+
+const limiterIdleTime = 10 * time.Minute
+
+type LimitOptions struct {
+	ClientRate          float64
+	ClientBurst         int
+	ClientConcurrency   int
+	MountRate           float64
+	MountBurst          int
+	MountConcurrency    int
+	ChecksumConcurrency int
+}
+
+type limiter struct {
+	rate     *rate.Limiter
+	active   int
+	lastSeen time.Time
+}
+
+// limiterSet applies a token bucket and a cap on concurrent requests per key,
+// a zero rate or concurrency meaning unlimited
+type limiterSet struct {
+	mu        sync.Mutex
+	name      string
+	rate      rate.Limit
+	burst     int
+	maxActive int
+	limiters  map[string]*limiter
+}
+
+var clientLimiters *limiterSet
+var mountLimiters *limiterSet
+var checksumSem chan struct{}
+
+func newLimiterSet(name string, r float64, burst int, maxActive int) *limiterSet {
+	if r <= 0 && maxActive <= 0 {
+		return nil
+	}
+	limit := rate.Inf
+	if r > 0 {
+		limit = rate.Limit(r)
+		if burst <= 0 {
+			burst = int(math.Ceil(r))
+		}
+	}
+	return &limiterSet{
+		name:      name,
+		rate:      limit,
+		burst:     burst,
+		maxActive: maxActive,
+		limiters:  make(map[string]*limiter),
+	}
+}
+
+func (ls *limiterSet) acquire(key string) (retryAfter time.Duration, ok bool) {
+	ls.mu.Lock()
+	defer ls.mu.Unlock()
+	l, exists := ls.limiters[key]
+	if !exists {
+		l = &limiter{rate: rate.NewLimiter(ls.rate, ls.burst)}
+		ls.limiters[key] = l
+	}
+	now := time.Now()
+	l.lastSeen = now
+	if ls.maxActive > 0 && l.active >= ls.maxActive {
+		return time.Second, false
+	}
+	r := l.rate.ReserveN(now, 1)
+	if !r.OK() {
+		return time.Second, false
+	}
+	if delay := r.DelayFrom(now); delay > 0 {
+		r.CancelAt(now)
+		return delay, false
+	}
+	l.active++
+	return 0, true
+}
+
+func (ls *limiterSet) release(key string) {
+	ls.mu.Lock()
+	defer ls.mu.Unlock()
+	if l, exists := ls.limiters[key]; exists {
+		l.active--
+		l.lastSeen = time.Now()
+	}
+}
+
+func (ls *limiterSet) evict() {
+	ls.mu.Lock()
+	defer ls.mu.Unlock()
+	for key, l := range ls.limiters {
+		if l.active == 0 && time.Since(l.lastSeen) > limiterIdleTime {
+			delete(ls.limiters, key)
+		}
+	}
+}
+
+func initLimits(options LimitOptions) {
+	clientLimiters = newLimiterSet("client", options.ClientRate, options.ClientBurst, options.ClientConcurrency)
+	mountLimiters = newLimiterSet("mount", options.MountRate, options.MountBurst, options.MountConcurrency)
+	if options.ChecksumConcurrency > 0 {
+		checksumSem = make(chan struct{}, options.ChecksumConcurrency)
+	}
+	if clientLimiters == nil && mountLimiters == nil {
+		return
+	}
+	go func() {
+		for range time.Tick(limiterIdleTime) {
+			for _, ls := range []*limiterSet{clientLimiters, mountLimiters} {
+				if ls != nil {
+					ls.evict()
+				}
+			}
+		}
+	}()
+}
+
+func mountName(rscPath string) string {
+	if ActiveConfigName == "S3Read" {
+		pe := strings.Split(rscPath, "/")
+		if len(pe) > 1 && pe[1] != "" {
+			return ActiveRscRoot + "/" + pe[1] + "/"
+		}
+	}
+	return ActiveRscRoot + "/"
+}
+
+func tooManyRequests(c *gin.Context, ls *limiterSet, key string, retryAfter time.Duration) {
+	c.Header("Retry-After", strconv.Itoa(int(math.Ceil(retryAfter.Seconds()))))
+	Error(c, fmt.Sprintf("too many requests for %s %s", ls.name, key), fmt.Errorf("limit reached"), http.StatusTooManyRequests)
+	c.Abort()
+}
+
+func limits(c *gin.Context) {
+	if clientLimiters != nil {
+		key := c.ClientIP()
+		retryAfter, ok := clientLimiters.acquire(key)
+		if !ok {
+			tooManyRequests(c, clientLimiters, key, retryAfter)
+			return
+		}
+		defer clientLimiters.release(key)
+	}
+	if mountLimiters != nil {
+		key := mountName(c.Param("rscPath"))
+		retryAfter, ok := mountLimiters.acquire(key)
+		if !ok {
+			tooManyRequests(c, mountLimiters, key, retryAfter)
+			return
+		}
+		defer mountLimiters.release(key)
+	}
+	c.Next()
+}
+
+func acquireChecksum(ctx context.Context) error {
+	if checksumSem == nil {
+		return nil
+	}
+	select {
+	case checksumSem <- struct{}{}:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func releaseChecksum() {
+	if checksumSem != nil {
+		<-checksumSem
+	}
+}
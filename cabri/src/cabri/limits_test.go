@@ -0,0 +1,140 @@
+package cabri
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"sync"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+)
+
+// newLimitedEngine serves GET /r/* with the limits, answering the principal of the request
+func newLimitedEngine(t *testing.T, options LimitOptions, proxies []string, handler gin.HandlerFunc) *gin.Engine {
+	t.Helper()
+	gin.SetMode(gin.TestMode)
+	engine := gin.New()
+	if err := initTrustedProxies(engine, proxies); err != nil {
+		t.Fatalf("initTrustedProxies: %v", err)
+	}
+	initLimits(options)
+	t.Cleanup(func() { initLimits(LimitOptions{}) })
+	if handler == nil {
+		handler = func(c *gin.Context) { c.String(http.StatusOK, principal(c)) }
+	}
+	engine.GET("/r/*rscPath", limits, handler)
+	return engine
+}
+
+func request(engine *gin.Engine, remoteAddr string, headers map[string]string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(http.MethodGet, "/r/a", nil)
+	req.RemoteAddr = remoteAddr
+	for k, v := range headers {
+		req.Header.Set(k, v)
+	}
+	w := httptest.NewRecorder()
+	engine.ServeHTTP(w, req)
+	return w
+}
+
+func TestClientRate(t *testing.T) {
+	engine := newLimitedEngine(t, LimitOptions{ClientRate: 0.5, ClientBurst: 1}, nil, nil)
+	if w := request(engine, "192.0.2.1:1000", nil); w.Code != http.StatusOK {
+		t.Fatalf("first request: status %d", w.Code)
+	}
+	w := request(engine, "192.0.2.1:1001", nil)
+	if w.Code != http.StatusTooManyRequests {
+		t.Fatalf("second request: status %d, expected 429", w.Code)
+	}
+	if retryAfter, err := strconv.Atoi(w.Header().Get("Retry-After")); err != nil || retryAfter < 1 {
+		t.Errorf("Retry-After %q, expected a positive number of seconds", w.Header().Get("Retry-After"))
+	}
+	if w := request(engine, "192.0.2.2:1000", nil); w.Code != http.StatusOK {
+		t.Errorf("other client: status %d", w.Code)
+	}
+}
+
+func TestClientConcurrency(t *testing.T) {
+	entered := make(chan struct{})
+	release := make(chan struct{})
+	engine := newLimitedEngine(t, LimitOptions{ClientConcurrency: 1}, nil, func(c *gin.Context) {
+		entered <- struct{}{}
+		<-release
+		c.Status(http.StatusOK)
+	})
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		request(engine, "192.0.2.1:1000", nil)
+	}()
+	<-entered
+	w := request(engine, "192.0.2.1:1001", nil)
+	close(release)
+	wg.Wait()
+	if w.Code != http.StatusTooManyRequests {
+		t.Fatalf("concurrent request: status %d, expected 429", w.Code)
+	}
+	if w.Header().Get("Retry-After") != "1" {
+		t.Errorf("Retry-After %q, expected 1", w.Header().Get("Retry-After"))
+	}
+	go func() { <-entered }()
+	if w := request(engine, "192.0.2.1:1002", nil); w.Code != http.StatusOK {
+		t.Errorf("request after release: status %d", w.Code)
+	}
+}
+
+func TestMountRate(t *testing.T) {
+	engine := newLimitedEngine(t, LimitOptions{MountRate: 0.5, MountBurst: 1}, nil, nil)
+	request(engine, "192.0.2.1:1000", nil)
+	if w := request(engine, "192.0.2.2:1000", nil); w.Code != http.StatusTooManyRequests {
+		t.Errorf("other client on the same mount: status %d, expected 429", w.Code)
+	}
+}
+
+func TestSpoofedHeadersFromUntrustedPeer(t *testing.T) {
+	engine := newLimitedEngine(t, LimitOptions{ClientRate: 0.5, ClientBurst: 1}, []string{"10.0.0.1"}, nil)
+	w := request(engine, "192.0.2.1:1000", map[string]string{
+		"X-Forwarded-For": "198.51.100.1",
+		"X-Remote-User":   "alice",
+	})
+	if w.Code != http.StatusOK {
+		t.Fatalf("first request: status %d", w.Code)
+	}
+	if w.Body.String() != "192.0.2.1" {
+		t.Errorf("principal %q, expected the peer address 192.0.2.1", w.Body.String())
+	}
+	w = request(engine, "192.0.2.1:1001", map[string]string{
+		"X-Forwarded-For": "198.51.100.2",
+		"X-Remote-User":   "bob",
+	})
+	if w.Code != http.StatusTooManyRequests {
+		t.Errorf("request with other spoofed headers: status %d, expected 429", w.Code)
+	}
+}
+
+func TestHeadersFromTrustedProxy(t *testing.T) {
+	engine := newLimitedEngine(t, LimitOptions{ClientRate: 0.5, ClientBurst: 1}, []string{"10.0.0.0/8"}, nil)
+	w := request(engine, "10.0.0.1:1000", map[string]string{
+		"X-Forwarded-For": "198.51.100.1",
+		"X-Remote-User":   "alice",
+	})
+	if w.Code != http.StatusOK || w.Body.String() != "alice" {
+		t.Fatalf("status %d principal %q, expected 200 alice", w.Code, w.Body.String())
+	}
+	w = request(engine, "10.0.0.1:1001", map[string]string{"X-Forwarded-For": "198.51.100.2"})
+	if w.Code != http.StatusOK || w.Body.String() != "198.51.100.2" {
+		t.Errorf("other client behind the proxy: status %d principal %q, expected 200 198.51.100.2", w.Code, w.Body.String())
+	}
+	if w := request(engine, "10.0.0.1:1002", map[string]string{"X-Forwarded-For": "198.51.100.1"}); w.Code != http.StatusTooManyRequests {
+		t.Errorf("same client behind the proxy: status %d, expected 429", w.Code)
+	}
+}
+
+func TestInvalidTrustedProxy(t *testing.T) {
+	if err := initTrustedProxies(gin.New(), []string{"not-an-address"}); err == nil {
+		t.Errorf("no error for an invalid trusted proxy")
+	}
+	trustedProxies = nil
+}
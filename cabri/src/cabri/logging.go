@@ -0,0 +1,189 @@
+package cabri
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"net"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/sirupsen/logrus"
+	"gopkg.in/natefinch/lumberjack.v2"
+)
+
+const RequestIdHeader = "X-Request-Id"
+
+// requestIdPattern matches the request ids accepted from clients
+var requestIdPattern = regexp.MustCompile(`^[A-Za-z0-9._-]{1,128}$`)
+
+var principalHeaders = []string{"X-Remote-User", "X-Forwarded-User", "Remote-User"}
+
+type AuditOptions struct {
+	FileName   string
+	MaxSize    int
+	MaxBackups int
+	MaxAge     int
+}
+
+var auditLog *logrus.Logger
+
+func SetLogFormat(format string) error {
+	switch format {
+	case "text":
+		logrus.SetFormatter(&logrus.TextFormatter{})
+	case "json":
+		logrus.SetFormatter(&logrus.JSONFormatter{})
+	default:
+		return fmt.Errorf("invalid log format %s", format)
+	}
+	return nil
+}
+
+func InitAudit(options AuditOptions) {
+	logrus.Debugf("InitAudit %+v", options)
+	auditLog = logrus.New()
+	auditLog.SetFormatter(&logrus.JSONFormatter{})
+	auditLog.SetLevel(logrus.InfoLevel)
+	auditLog.SetOutput(&lumberjack.Logger{
+		Filename:   options.FileName,
+		MaxSize:    options.MaxSize,
+		MaxBackups: options.MaxBackups,
+		MaxAge:     options.MaxAge,
+	})
+}
+
+func newRequestId() string {
+	b := make([]byte, 8)
+	if _, err := rand.Read(b); err != nil {
+		return fmt.Sprintf("%x", time.Now().UnixNano())
+	}
+	return hex.EncodeToString(b)
+}
+
+func RequestId() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		id := c.Request.Header.Get(RequestIdHeader)
+		if !requestIdPattern.MatchString(id) {
+			id = newRequestId()
+		}
+		c.Set("cabri.requestId", id)
+		c.Writer.Header().Set(RequestIdHeader, id)
+		c.Next()
+	}
+}
+
+func reqLog(c *gin.Context) *logrus.Entry {
+	if id, exists := c.Get("cabri.requestId"); exists {
+		return logrus.WithField("request_id", id)
+	}
+	return logrus.NewEntry(logrus.StandardLogger())
+}
+
+func AccessLogger() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		start := time.Now()
+		c.Next()
+		entry := reqLog(c).WithFields(logrus.Fields{
+			"method":   c.Request.Method,
+			"path":     c.Request.URL.Path,
+			"query":    c.Request.URL.RawQuery,
+			"status":   c.Writer.Status(),
+			"size":     c.Writer.Size(),
+			"duration": time.Since(start).String(),
+			"client":   c.ClientIP(),
+		})
+		if c.Writer.Status() >= 500 {
+			entry.Error("access")
+		} else {
+			entry.Info("access")
+		}
+	}
+}
+
+var trustedProxies []*net.IPNet
+
+// initTrustedProxies parses the IP addresses or CIDR ranges of the reverse proxies
+// whose forwarding and user headers are trusted
+func initTrustedProxies(engine *gin.Engine, proxies []string) error {
+	trustedProxies = nil
+	var cidrs []string
+	for _, proxy := range proxies {
+		cidr := strings.TrimSpace(proxy)
+		if !strings.Contains(cidr, "/") {
+			if ip := net.ParseIP(cidr); ip != nil && ip.To4() != nil {
+				cidr += "/32"
+			} else {
+				cidr += "/128"
+			}
+		}
+		_, ipNet, err := net.ParseCIDR(cidr)
+		if err != nil {
+			return fmt.Errorf("invalid trusted proxy %s", proxy)
+		}
+		trustedProxies = append(trustedProxies, ipNet)
+		cidrs = append(cidrs, cidr)
+	}
+	return engine.SetTrustedProxies(cidrs)
+}
+
+func fromTrustedProxy(c *gin.Context) bool {
+	ip := net.ParseIP(c.RemoteIP())
+	for _, ipNet := range trustedProxies {
+		if ip != nil && ipNet.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// principal is the user told by a trusted proxy, or the client IP address
+func principal(c *gin.Context) string {
+	if fromTrustedProxy(c) {
+		for _, header := range principalHeaders {
+			if user := c.Request.Header.Get(header); user != "" {
+				return user
+			}
+		}
+		if user, _, ok := c.Request.BasicAuth(); ok {
+			return user
+		}
+	}
+	return c.ClientIP()
+}
+
+func setAudit(c *gin.Context, size int64, checksum string) {
+	c.Set("cabri.auditSize", size)
+	c.Set("cabri.auditChecksum", checksum)
+}
+
+func auditor(c *gin.Context) {
+	c.Next()
+	if auditLog == nil {
+		return
+	}
+	fields := logrus.Fields{
+		"request_id": c.Keys["cabri.requestId"],
+		"principal":  principal(c),
+		"method":     c.Request.Method,
+		"path":       c.Request.URL.Path,
+		"status":     c.Writer.Status(),
+	}
+	if size, exists := c.Get("cabri.auditSize"); exists {
+		fields["size"] = size
+	}
+	if checksum, exists := c.Get("cabri.auditChecksum"); exists && checksum != "" {
+		fields["checksum"] = checksum
+	}
+	if msg, exists := c.Get("cabri.error"); exists {
+		fields["outcome"] = "failure"
+		fields["error"] = msg
+	} else if c.Writer.Status() >= 400 {
+		fields["outcome"] = "failure"
+	} else {
+		fields["outcome"] = "success"
+	}
+	auditLog.WithFields(fields).Info("audit")
+}
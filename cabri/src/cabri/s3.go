@@ -1,10 +1,11 @@
 package cabri
 
 import (
+	"cabri/tracing"
+	"context"
 	"errors"
 	"fmt"
 	"io"
-	"io/ioutil"
 	"net/http"
 	"os"
 	"path/filepath"
@@ -16,6 +17,7 @@ import (
 
 	"github.com/gin-gonic/gin"
 	"github.com/sirupsen/logrus"
+	"go.opentelemetry.io/otel/attribute"
 
 	"github.com/aws/aws-sdk-go/aws"
 	"github.com/aws/aws-sdk-go/aws/awserr"
@@ -25,6 +27,7 @@ import (
 )
 
 var s3Svc *s3.S3
+var stsSvc *sts.STS
 var mu sync.Mutex
 
 func getS3Svc() {
@@ -33,9 +36,12 @@ func getS3Svc() {
 		defer mu.Unlock()
 		if s3Svc == nil {
 			sess := session.Must(session.NewSession())
-			stsSvc := sts.New(sess)
+			stsSvc = sts.New(sess)
 			callerIdentity, err := stsSvc.GetCallerIdentity(&sts.GetCallerIdentityInput{})
 			logrus.Debugf("getS3Svc callerIdentity %v\nerr %v\n", callerIdentity, err)
+			if err != nil {
+				logrus.Errorf("getS3Svc GetCallerIdentity: %v\n", err)
+			}
 			s3Svc = s3.New(sess)
 			logrus.Debugf("getS3Svc s3Svc %+v\n", *s3Svc)
 		}
@@ -43,20 +49,23 @@ func getS3Svc() {
 }
 
 func S3GetContent(c *gin.Context) {
-	logrus.Debugf("S3GetContent %s", c.Keys["cabri.rscPath"])
+	reqLog(c).Debugf("S3GetContent %s", c.Keys["cabri.rscPath"])
 	pe := strings.Split(c.Keys["cabri.rscPath"].(string), "/")
 	s3GetContent(c, pe[1], strings.Join(pe[2:], "/"), "")
 }
 
 func s3GetContent(c *gin.Context, bucketName string, objectKey string, checksum string) {
 	getS3Svc()
-	logrus.Debugf("s3GetContent %s %s", bucketName, objectKey)
+	reqLog(c).Debugf("s3GetContent %s %s", bucketName, objectKey)
 	input := &s3.GetObjectInput{
 		Bucket: aws.String(bucketName),
 		Key:    aws.String(objectKey),
 	}
-	result, err := s3Svc.GetObject(input)
+	ctx, span := tracing.Start(c.Request.Context(), "s3.GetObject",
+		attribute.String("s3.bucket", bucketName), attribute.String("s3.key", objectKey))
+	result, err := s3Svc.GetObjectWithContext(ctx, input)
 	if err != nil {
+		tracing.End(span, err)
 		s3GetContentError(c, bucketName, objectKey, err, 0)
 		return
 	}
@@ -64,14 +73,16 @@ func s3GetContent(c *gin.Context, bucketName string, objectKey string, checksum
 	ln := *result.ContentLength
 	ext := filepath.Ext(objectKey)
 	var tmpfile *os.File
-	if tmpfile, err = ioutil.TempFile("", fmt.Sprintf("cabri*%s", ext)); err != nil {
+	if tmpfile, err = createTempFile("", fmt.Sprintf("cabri*%s", ext), 0600); err != nil {
+		tracing.End(span, err)
 		Error(c, fmt.Sprintf("s3GetContent objectKey %s", objectKey), err, 0)
 		return
 	}
-	defer os.Remove(tmpfile.Name())
-	defer tmpfile.Close()
+	defer removeTempFile(tmpfile)
 	var wln int64
-	if wln, err = io.Copy(tmpfile, result.Body); err != nil {
+	wln, err = io.Copy(tmpfile, result.Body)
+	tracing.End(span, err)
+	if err != nil {
 		Error(c, fmt.Sprintf("s3GetContent objectKey %s", objectKey), err, 0)
 		return
 	}
@@ -83,11 +94,11 @@ func s3GetContent(c *gin.Context, bucketName string, objectKey string, checksum
 	// t, _ := http.ParseTime()
 	os.Chtimes(tmpfile.Name(), *result.LastModified, *result.LastModified)
 	if checksum == "" {
-		logrus.Debugf("s3GetContent ServeFile on %s", tmpfile.Name())
+		reqLog(c).Debugf("s3GetContent ServeFile on %s", tmpfile.Name())
 		http.ServeFile(c.Writer, c.Request, tmpfile.Name())
 	} else {
 		var cs string
-		if cs, err = GetChecksum(checksum, tmpfile.Name()); err != nil {
+		if cs, err = GetChecksum(c.Request.Context(), checksum, tmpfile.Name()); err != nil {
 			Error(c, fmt.Sprintf("s3GetContent objectKey %s", objectKey), err, http.StatusBadRequest)
 			return
 		}
@@ -105,7 +116,7 @@ func s3GetContentError(c *gin.Context, bucket string, key string, err error, sta
 	var s3err awserr.RequestFailure
 	path := fmt.Sprintf("%s/%s", bucket, key)
 	if errors.As(err, &s3err) {
-		logrus.Debugf("s3GetContentError awserr.RequestFailure %s err %#v\n", path, err)
+		reqLog(c).Debugf("s3GetContentError awserr.RequestFailure %s err %#v\n", path, err)
 		if s3err.StatusCode() == http.StatusNotFound {
 			status = http.StatusNotFound
 		} else {
@@ -118,7 +129,7 @@ func s3GetContentError(c *gin.Context, bucket string, key string, err error, sta
 }
 
 func S3List(c *gin.Context) {
-	logrus.Debugf("S3List %s", c.Keys["cabri.rscPath"])
+	reqLog(c).Debugf("S3List %s", c.Keys["cabri.rscPath"])
 	pe := strings.Split(c.Keys["cabri.rscPath"].(string), "/")
 	s3List(c, pe[1], strings.Join(append([]string{""}, pe[2:]...), "/"))
 }
@@ -132,7 +143,7 @@ type s3ListEntry struct {
 
 func s3List(c *gin.Context, bucketName string, prefix string) {
 	getS3Svc()
-	logrus.Debugf("s3List %+v %s %s", *s3Svc.Client, bucketName, prefix)
+	reqLog(c).Debugf("s3List %+v %s %s", *s3Svc.Client, bucketName, prefix)
 	var input *s3.ListObjectsV2Input
 	input = &s3.ListObjectsV2Input{
 		Bucket:    aws.String(bucketName),
@@ -143,10 +154,13 @@ func s3List(c *gin.Context, bucketName string, prefix string) {
 	done := false
 	listByKey := make(map[string]s3ListEntry)
 	for !done {
-		logrus.Debugf("s3List input b %s p %s c %s", bucketName, prefix, input.ContinuationToken)
+		reqLog(c).Debugf("s3List input b %s p %s c %s", bucketName, prefix, aws.StringValue(input.ContinuationToken))
 
-		result, err := s3Svc.ListObjectsV2(input)
-		logrus.Debugf("s3List res r %v e %v", result, err)
+		ctx, span := tracing.Start(c.Request.Context(), "s3.ListObjectsV2",
+			attribute.String("s3.bucket", bucketName), attribute.String("s3.prefix", prefix))
+		result, err := s3Svc.ListObjectsV2WithContext(ctx, input)
+		tracing.End(span, err)
+		reqLog(c).Debugf("s3List res r %v e %v", result, err)
 
 		if err != nil {
 			s3ListError(c, bucketName, prefix, err, 0)
@@ -154,7 +168,7 @@ func s3List(c *gin.Context, bucketName string, prefix string) {
 		}
 		done = !*result.IsTruncated
 		for _, content := range result.Contents {
-			logrus.Debugf("s3List content %s", *content.Key)
+			reqLog(c).Debugf("s3List content %s", *content.Key)
 			listByKey[*content.Key] = s3ListEntry{
 				key:          *content.Key,
 				lastModified: *content.LastModified,
@@ -162,7 +176,7 @@ func s3List(c *gin.Context, bucketName string, prefix string) {
 			}
 		}
 		for _, commonPrefix := range result.CommonPrefixes {
-			logrus.Debugf("s3List prefix  %s", *commonPrefix.Prefix)
+			reqLog(c).Debugf("s3List prefix  %s", *commonPrefix.Prefix)
 			listByKey[*commonPrefix.Prefix] = s3ListEntry{
 				key:      *commonPrefix.Prefix,
 				isPrefix: true,
@@ -182,7 +196,7 @@ func s3List(c *gin.Context, bucketName string, prefix string) {
 	pKeys := make([]string, 0, len(listByKey))
 	cKeys := make([]string, 0, len(listByKey))
 	for key, entry := range listByKey {
-		logrus.Debugf("s3List listByKey k %s e %v", key, entry)
+		reqLog(c).Debugf("s3List listByKey k %s e %v", key, entry)
 		if entry.isPrefix {
 			pKeys = append(pKeys, key)
 		} else {
@@ -191,16 +205,18 @@ func s3List(c *gin.Context, bucketName string, prefix string) {
 	}
 	sort.Strings(pKeys)
 	sort.Strings(cKeys)
-	logrus.Debugf("s3List pKeys %v cKeys %v", pKeys, cKeys)
+	reqLog(c).Debugf("s3List pKeys %v cKeys %v", pKeys, cKeys)
 
+	meta := listMeta(c)
 	for _, key := range pKeys {
-		fmt.Fprintf(w, "/%s/%s\n", bucketName, key)
+		writeListEntry(w, fmt.Sprintf("/%s/%s", bucketName, key), meta, -1, time.Time{})
 	}
 	for _, key := range cKeys {
 		if key == prefix[1:] {
 			continue
 		}
-		fmt.Fprintf(w, "/%s/%s\n", bucketName, key)
+		entry := listByKey[key]
+		writeListEntry(w, fmt.Sprintf("/%s/%s", bucketName, key), meta, entry.size, entry.lastModified)
 	}
 	fmt.Fprintf(w, "\n")
 }
@@ -209,7 +225,7 @@ func s3ListError(c *gin.Context, bucket string, prefix string, err error, status
 	var s3err awserr.RequestFailure
 	path := fmt.Sprintf("%s/%s", bucket, prefix)
 	if errors.As(err, &s3err) {
-		logrus.Debugf("s3ListError awserr.RequestFailure %s err %#v\n", path, err)
+		reqLog(c).Debugf("s3ListError awserr.RequestFailure %s err %#v\n", path, err)
 		if s3err.StatusCode() == http.StatusNotFound {
 			status = http.StatusNotFound
 		} else {
@@ -221,8 +237,10 @@ func s3ListError(c *gin.Context, bucket string, prefix string, err error, status
 	ListError(c, path, err, status)
 }
 
+// S3StatContent downloads the whole object to compute its sha256 checksum, which S3 does not store,
+// ?meta listings telling the size and modification time of the objects without it
 func S3StatContent(c *gin.Context) {
-	logrus.Debugf("S3StatContent %s", c.Keys["cabri.rscPath"])
+	reqLog(c).Debugf("S3StatContent %s", c.Keys["cabri.rscPath"])
 	pe := strings.Split(c.Keys["cabri.rscPath"].(string), "/")
 	s3GetContent(c, pe[1], strings.Join(pe[2:], "/"), "sha256")
 	if _, exists := c.Get("cabri.statContent"); !exists {
@@ -235,3 +253,26 @@ func S3StatContent(c *gin.Context) {
 	w.Header().Set("Checksum", statContent.Checksum)
 	w.WriteHeader(http.StatusOK)
 }
+
+func S3Ready(ctx context.Context) (statuses []MountStatus) {
+	getS3Svc()
+	logrus.Debugf("S3Ready buckets %v", ActiveReadyBuckets)
+	stsCtx, span := tracing.Start(ctx, "sts.GetCallerIdentity")
+	_, err := stsSvc.GetCallerIdentityWithContext(stsCtx, &sts.GetCallerIdentityInput{})
+	tracing.End(span, err)
+	if err != nil {
+		return []MountStatus{newMountStatus("", err)}
+	}
+	if len(ActiveReadyBuckets) == 0 {
+		return []MountStatus{newMountStatus("", nil)}
+	}
+	for _, bucketName := range ActiveReadyBuckets {
+		headCtx, span := tracing.Start(ctx, "s3.HeadBucket", attribute.String("s3.bucket", bucketName))
+		_, err = s3Svc.HeadBucketWithContext(headCtx, &s3.HeadBucketInput{
+			Bucket: aws.String(bucketName),
+		})
+		tracing.End(span, err)
+		statuses = append(statuses, newMountStatus(bucketName, err))
+	}
+	return
+}
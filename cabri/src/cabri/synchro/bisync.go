@@ -0,0 +1,403 @@
+package synchro
+
+import (
+	"cabri/client"
+	"cabri/tracing"
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"sync"
+
+	"github.com/sirupsen/logrus"
+	"go.opentelemetry.io/otel/attribute"
+)
+
+// ConflictPolicy decides which version is kept when a content changed on both sides
+type ConflictPolicy string
+
+const (
+	ConflictNewer    ConflictPolicy = "newer"
+	ConflictSource   ConflictPolicy = "source"
+	ConflictKeepBoth ConflictPolicy = "keep-both"
+)
+
+const conflictSuffix = ".conflict"
+
+// side is the source or the target of a bidirectional synchronization
+type side struct {
+	name   string
+	c      *client.Client
+	listed *sync.Map
+	target bool
+}
+
+func (s *Syncer) sides() (source side, target side) {
+	return side{name: "source", c: s.source, listed: &s.listed},
+		side{name: "target", c: s.target, listed: &s.listedTarget, target: true}
+}
+
+func (sd side) info(path string) *client.Info {
+	if info, ok := sd.listed.Load(path); ok {
+		return info.(*client.Info)
+	}
+	return nil
+}
+
+func (s *Syncer) baseline(path string) *stateEntry {
+	entry, err := s.options.State.get(s.stateBucket, path)
+	if err != nil {
+		logrus.WithField("path", path).WithError(err).Error("baseline: state")
+		return nil
+	}
+	return entry
+}
+
+// changed tells whether the content listed on a side differs from the baseline
+func changed(sd side, info *client.Info, b *stateEntry) bool {
+	if info == nil {
+		return false
+	}
+	if b == nil {
+		return true
+	}
+	lastModified := b.LastModified
+	if sd.target {
+		lastModified = b.TargetLastModified
+	}
+	return info.Size != b.Size || !info.LastModified.Equal(lastModified)
+}
+
+// decide logs a decision and adds it to the plan in dry-run, reporting whether to perform it
+func (s *Syncer) decide(action string, path string, sd side, reason string, bytes int64) bool {
+	logrus.WithFields(logrus.Fields{"path": path, "side": sd.name, "reason": reason}).Infof("bisync: %s", action)
+	if s.options.DryRun {
+		s.addPlan(action, path, fmt.Sprintf("%s, on %s", reason, sd.name), bytes)
+		return false
+	}
+	return true
+}
+
+func (s *Syncer) conflict() {
+	s.countStat(func(r *Report) { r.Conflicts++ })
+}
+
+// listSide lists a directory with metadata, a missing directory having no entries
+func (s *Syncer) listSide(ctx context.Context, sd side, path string) (infos map[string]*client.Info, exists bool, err error) {
+	var list []*client.Info
+	err = s.retry(ctx, "bisyncDir: list "+sd.name, path, func() (err error) {
+		list, err = sd.c.ListInfo(ctx, path)
+		return
+	})
+	if errors.Is(err, client.ErrNotFound) {
+		return map[string]*client.Info{}, false, nil
+	}
+	if err != nil {
+		return
+	}
+	infos = make(map[string]*client.Info, len(list))
+	for _, info := range list {
+		infos[info.Path] = info
+		if !info.IsDir {
+			sd.listed.Store(info.Path, info)
+		}
+	}
+	return infos, true, nil
+}
+
+// bisyncDir compares the entries of a directory on both sides with the baseline,
+// resolving its subdirectories and returning the entries to process
+func (s *Syncer) bisyncDir(ctx context.Context, id string, path string) (entries []string, err error) {
+	ctx, span := tracing.Start(ctx, "bisyncDir", attribute.String("cabri.path", path))
+	defer func() { tracing.End(span, err) }()
+
+	logrus.Debugf("bisyncDir%s %s", id, path)
+	source, target := s.sides()
+	infos := make(map[side]map[string]*client.Info)
+	for _, sd := range []side{source, target} {
+		var exists bool
+		if infos[sd], exists, err = s.listSide(ctx, sd, path); err != nil {
+			logrus.WithFields(logrus.Fields{"path": path, "side": sd.name}).WithError(err).Error("bisyncDir: list")
+			return nil, err
+		}
+		if !exists && !s.options.DryRun {
+			if err = sd.c.Mkdir(ctx, path); err != nil {
+				return nil, err
+			}
+		}
+	}
+	s.countStat(func(r *Report) { r.DirsListed++ })
+
+	names := make(map[string]bool)
+	for _, sd := range []side{source, target} {
+		for name := range infos[sd] {
+			names[name] = true
+		}
+	}
+	var known []string
+	if known, err = s.options.State.children(s.stateBucket, path); err != nil {
+		return nil, err
+	}
+	for _, name := range known {
+		names[name] = true
+	}
+	all := make([]string, 0, len(names))
+	for name := range names {
+		all = append(all, name)
+	}
+	sort.Strings(all)
+
+	for _, entry := range s.filterEntries(all) {
+		inSource, inTarget := infos[source][entry] != nil, infos[target][entry] != nil
+		if !isDir(entry) {
+			if inSource || inTarget {
+				entries = append(entries, entry)
+			} else {
+				s.forgetState(entry)
+			}
+			continue
+		}
+		recurse, derr := s.bisyncSubdir(ctx, entry, inSource, inTarget)
+		if derr != nil {
+			logrus.WithField("path", entry).WithError(derr).Error("bisyncDir")
+			s.countStat(func(r *Report) { r.DirsFailed++ })
+			s.emit(Event{Kind: EventFailure, Path: entry, Err: derr})
+			continue
+		}
+		if recurse {
+			entries = append(entries, entry)
+		}
+	}
+	return entries, nil
+}
+
+// bisyncSubdir creates on the other side a directory created on one side,
+// and propagates the deletion of a directory unless the other side changed under it
+func (s *Syncer) bisyncSubdir(ctx context.Context, path string, inSource bool, inTarget bool) (recurse bool, err error) {
+	source, target := s.sides()
+	switch {
+	case inSource && inTarget:
+		s.recordBaseline(path, &stateEntry{Size: -1})
+		return true, nil
+	case !inSource && !inTarget:
+		s.forgetState(path)
+		return false, nil
+	}
+	from, to := source, target
+	if inTarget {
+		from, to = target, source
+	}
+	reason := "created on " + from.name
+	if s.baseline(path) != nil {
+		var unchanged bool
+		if unchanged, err = s.subtreeUnchanged(ctx, from, path); err != nil {
+			return
+		}
+		if unchanged || (s.options.ConflictPolicy == ConflictSource && to == source) {
+			reason = "deleted on " + to.name
+			if !unchanged {
+				s.conflict()
+				reason += ", changed on " + from.name + ", source wins"
+			}
+			if s.decide("delete", path, from, reason, 0) {
+				if err = s.retry(ctx, "bisyncSubdir: delete", path, func() error {
+					return from.c.Delete(ctx, path, true)
+				}); err != nil {
+					return
+				}
+				s.countStat(func(r *Report) { r.Deleted++ })
+				s.emit(Event{Kind: EventDelete, Path: path, Reason: reason})
+				s.forgetState(path)
+			}
+			return false, nil
+		}
+		s.conflict()
+		reason = "deleted on " + to.name + ", changed on " + from.name + ", keeping the changes"
+	}
+	if s.decide("mkdir", path, to, reason, 0) {
+		if err = s.retry(ctx, "bisyncSubdir: mkdir", path, func() error {
+			return to.c.Mkdir(ctx, path)
+		}); err != nil {
+			return
+		}
+		s.countStat(func(r *Report) { r.DirsCreated++ })
+		s.emit(Event{Kind: EventMkdir, Path: path, Reason: reason})
+		s.recordBaseline(path, &stateEntry{Size: -1})
+	}
+	return true, nil
+}
+
+// subtreeUnchanged tells whether nothing was created or modified under dir on a side since the baseline
+func (s *Syncer) subtreeUnchanged(ctx context.Context, sd side, dir string) (bool, error) {
+	infos, err := sd.c.ListInfo(ctx, dir)
+	if err != nil {
+		return false, err
+	}
+	for _, info := range infos {
+		b := s.baseline(info.Path)
+		if b == nil {
+			return false, nil
+		}
+		if !info.IsDir {
+			if changed(sd, info, b) {
+				return false, nil
+			}
+			continue
+		}
+		if unchanged, err := s.subtreeUnchanged(ctx, sd, info.Path); err != nil || !unchanged {
+			return false, err
+		}
+	}
+	return true, nil
+}
+
+// bisyncContent propagates the creation, modification or deletion of a content on one side to the other,
+// resolving the changes on both sides according to the conflict policy
+func (s *Syncer) bisyncContent(ctx context.Context, id string, path string) (err error) {
+	ctx, span := tracing.Start(ctx, "bisyncContent", attribute.String("cabri.path", path))
+	defer func() { tracing.End(span, err) }()
+
+	source, target := s.sides()
+	src, tgt := source.info(path), target.info(path)
+	b := s.baseline(path)
+	srcChanged, tgtChanged := changed(source, src, b), changed(target, tgt, b)
+	logrus.Debugf("bisyncContent%s %s source %v changed %v target %v changed %v", id, path, src != nil, srcChanged, tgt != nil, tgtChanged)
+
+	switch {
+	case src != nil && tgt == nil:
+		switch {
+		case b == nil:
+			return s.bisyncCopy(ctx, id, source, target, path, path, "created on source", src.Size)
+		case srcChanged:
+			s.conflict()
+			return s.bisyncCopy(ctx, id, source, target, path, path, "deleted on target, changed on source, keeping the changes", src.Size)
+		}
+		return s.bisyncDelete(ctx, source, path, "deleted on target")
+	case src == nil && tgt != nil:
+		switch {
+		case b == nil:
+			return s.bisyncCopy(ctx, id, target, source, path, path, "created on target", tgt.Size)
+		case tgtChanged && s.options.ConflictPolicy == ConflictSource:
+			s.conflict()
+			return s.bisyncDelete(ctx, target, path, "deleted on source, changed on target, source wins")
+		case tgtChanged:
+			s.conflict()
+			return s.bisyncCopy(ctx, id, target, source, path, path, "deleted on source, changed on target, keeping the changes", tgt.Size)
+		}
+		return s.bisyncDelete(ctx, target, path, "deleted on source")
+	case src == nil && tgt == nil:
+		s.forgetState(path)
+		return nil
+	}
+
+	switch {
+	case !srcChanged && !tgtChanged:
+		logrus.Debugf("bisyncContent%s %s unchanged", id, path)
+		s.countStat(func(r *Report) { r.FilesSkipped++ })
+		return nil
+	case srcChanged && !tgtChanged:
+		return s.bisyncCopy(ctx, id, source, target, path, path, "changed on source", src.Size)
+	case !srcChanged && tgtChanged:
+		return s.bisyncCopy(ctx, id, target, source, path, path, "changed on target", tgt.Size)
+	}
+
+	var srcInfo, tgtInfo *client.Info
+	err = s.retry(ctx, "bisyncContent: head", path, func() (err error) {
+		if srcInfo, err = source.c.Stat(ctx, path); err == nil {
+			tgtInfo, err = target.c.Stat(ctx, path)
+		}
+		return
+	})
+	if err != nil {
+		return
+	}
+	if srcInfo.Checksum != "" && srcInfo.Checksum == tgtInfo.Checksum {
+		logrus.WithField("path", path).Info("bisync: skip, changed on both sides with the same checksum")
+		s.countStat(func(r *Report) { r.FilesSkipped++ })
+		s.recordBaseline(path, &stateEntry{
+			Size:               srcInfo.Size,
+			LastModified:       src.LastModified,
+			TargetLastModified: tgt.LastModified,
+			Checksum:           srcInfo.Checksum,
+		})
+		return nil
+	}
+
+	s.conflict()
+	switch s.options.ConflictPolicy {
+	case ConflictSource:
+		return s.bisyncCopy(ctx, id, source, target, path, path, "changed on both sides, source wins", src.Size)
+	case ConflictKeepBoth:
+		conflictPath := path + conflictSuffix
+		reason := "changed on both sides, keeping the target version as " + conflictPath
+		if err = s.bisyncCopy(ctx, id, target, target, path, conflictPath, reason, tgt.Size); err != nil {
+			return
+		}
+		if err = s.bisyncCopy(ctx, id, target, source, path, conflictPath, reason, tgt.Size); err != nil {
+			return
+		}
+		return s.bisyncCopy(ctx, id, source, target, path, path, reason, src.Size)
+	}
+	if tgt.LastModified.After(src.LastModified) {
+		return s.bisyncCopy(ctx, id, target, source, path, path, "changed on both sides, target newer", tgt.Size)
+	}
+	return s.bisyncCopy(ctx, id, source, target, path, path, "changed on both sides, source newer", src.Size)
+}
+
+func (s *Syncer) bisyncCopy(ctx context.Context, id string, from side, to side, fromPath string, toPath string, reason string, size int64) (err error) {
+	if !s.decide("put", toPath, to, reason, size) {
+		return nil
+	}
+	var info *client.Info
+	var sent int64
+	var baseSize int64 = -1
+	if base := to.info(toPath); base != nil {
+		baseSize = base.Size
+	}
+	err = s.retry(ctx, "bisyncContent: copy", toPath, func() (err error) {
+		info, sent, err = s.copyContent(ctx, id, from.c, to.c, fromPath, toPath, baseSize)
+		return
+	})
+	if err != nil {
+		logrus.WithField("path", toPath).WithError(err).Error("bisyncContent: copy")
+		return
+	}
+	s.countStat(func(r *Report) {
+		r.FilesCopied++
+		r.BytesTransferred += sent
+	})
+	s.emit(Event{Kind: EventPut, Path: toPath, Bytes: info.Size, Reason: reason})
+	s.recordBaseline(toPath, &stateEntry{
+		Size:               info.Size,
+		LastModified:       info.LastModified,
+		TargetLastModified: info.LastModified,
+		Checksum:           info.Checksum,
+	})
+	return nil
+}
+
+func (s *Syncer) bisyncDelete(ctx context.Context, sd side, path string, reason string) (err error) {
+	if !s.decide("delete", path, sd, reason, 0) {
+		return nil
+	}
+	err = s.retry(ctx, "bisyncContent: delete", path, func() error {
+		return sd.c.Delete(ctx, path, false)
+	})
+	if err != nil && !errors.Is(err, client.ErrNotFound) {
+		logrus.WithField("path", path).WithError(err).Error("bisyncContent: delete")
+		return
+	}
+	s.countStat(func(r *Report) { r.Deleted++ })
+	s.emit(Event{Kind: EventDelete, Path: path, Reason: reason})
+	s.forgetState(path)
+	return nil
+}
+
+func (s *Syncer) recordBaseline(path string, entry *stateEntry) {
+	if s.options.DryRun {
+		return
+	}
+	if err := s.options.State.put(s.stateBucket, path, *entry); err != nil {
+		logrus.WithField("path", path).WithError(err).Error("recordBaseline")
+	}
+}
@@ -0,0 +1,192 @@
+package synchro
+
+import (
+	"cabri/client"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// checkpoint is the progress of an interrupted run: the entries not processed yet
+// with the listed information of the files, the target entries to delete found so far
+// and the directories waiting for their entries
+type checkpoint struct {
+	Source     string                      `json:"source"`
+	Target     string                      `json:"target"`
+	Time       time.Time                   `json:"time"`
+	Pending    []string                    `json:"pending"`
+	Listed     map[string]checkpointListed `json:"listed,omitempty"`
+	Extraneous map[string]int              `json:"extraneous,omitempty"`
+	Dirs       map[string]checkpointDir    `json:"dirs,omitempty"`
+	DirTimes   map[string]time.Time        `json:"dir_times,omitempty"`
+}
+
+// checkpointListed is the information of a pending file listed in its directory on each side,
+// nil when absent, as the verification and the bidirectional synchronization rely on it
+type checkpointListed struct {
+	Source *client.Info `json:"source,omitempty"`
+	Target *client.Info `json:"target,omitempty"`
+}
+
+type checkpointDir struct {
+	Pending    int       `json:"pending"`
+	Modified   bool      `json:"modified"`
+	TargetTime time.Time `json:"target_time"`
+}
+
+func (s *Syncer) checkpointEnabled() bool {
+	return s.options.Checkpoint != "" && !s.options.DryRun
+}
+
+func (s *Syncer) saveCheckpoint(queue *workQueue) {
+	if err := s.writeCheckpoint(s.snapshot(queue)); err != nil {
+		logrus.Errorf("runSynchro: checkpoint: %v", err)
+	}
+}
+
+// snapshot returns the progress of the run, queue being nil once all the entries are processed
+func (s *Syncer) snapshot(queue *workQueue) *checkpoint {
+	s.checkpointMu.Lock()
+	defer s.checkpointMu.Unlock()
+	cp := &checkpoint{
+		Source:     s.options.SourceUrl,
+		Target:     s.options.TargetUrl,
+		Time:       time.Now(),
+		Pending:    []string{},
+		Extraneous: make(map[string]int),
+		Dirs:       make(map[string]checkpointDir),
+		DirTimes:   make(map[string]time.Time),
+	}
+	if queue != nil {
+		cp.Pending = queue.snapshot()
+	}
+	cp.Listed = make(map[string]checkpointListed)
+	for _, path := range cp.Pending {
+		if isDir(path) {
+			continue
+		}
+		var cl checkpointListed
+		if info, ok := s.listed.Load(path); ok {
+			cl.Source = info.(*client.Info)
+		}
+		if info, ok := s.listedTarget.Load(path); ok {
+			cl.Target = info.(*client.Info)
+		}
+		cp.Listed[path] = cl
+	}
+	s.extraneousMu.Lock()
+	for path, count := range s.extraneous {
+		cp.Extraneous[path] = count
+	}
+	s.extraneousMu.Unlock()
+	s.dirsMu.Lock()
+	for path, dp := range s.dirs {
+		cp.Dirs[path] = checkpointDir{Pending: dp.pending, Modified: dp.modified, TargetTime: dp.targetTime}
+	}
+	// completed directories whose time is being set
+	for path, dp := range s.completedDirs {
+		cp.Dirs[path] = checkpointDir{Pending: 0, Modified: dp.modified, TargetTime: dp.targetTime}
+	}
+	for path, t := range s.dirTimes {
+		cp.DirTimes[path] = t
+	}
+	s.dirsMu.Unlock()
+	return cp
+}
+
+// writeCheckpoint replaces the checkpoint file, a temporary file being renamed
+// so that an interruption never leaves a truncated checkpoint
+func (s *Syncer) writeCheckpoint(cp *checkpoint) error {
+	content, err := json.Marshal(cp)
+	if err != nil {
+		return err
+	}
+	fileName := s.options.Checkpoint
+	var f *os.File
+	if f, err = ioutil.TempFile(filepath.Dir(fileName), filepath.Base(fileName)+"*"); err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+	if _, err = f.Write(content); err != nil {
+		f.Close()
+		return err
+	}
+	if err = f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(f.Name(), fileName)
+}
+
+// readCheckpoint returns nil if there is no checkpoint file
+func (s *Syncer) readCheckpoint() (*checkpoint, error) {
+	content, err := ioutil.ReadFile(s.options.Checkpoint)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	cp := &checkpoint{}
+	if err = json.Unmarshal(content, cp); err != nil {
+		return nil, fmt.Errorf("checkpoint %s: %v", s.options.Checkpoint, err)
+	}
+	if cp.Source != s.options.SourceUrl || cp.Target != s.options.TargetUrl {
+		return nil, fmt.Errorf("checkpoint %s is for %s to %s", s.options.Checkpoint, cp.Source, cp.Target)
+	}
+	// the verification and the bidirectional synchronization take an unlisted file as absent
+	if s.options.Verify || s.options.Bidirectional {
+		for _, path := range cp.Pending {
+			if cl := cp.Listed[path]; !isDir(path) && cl.Source == nil && cl.Target == nil {
+				return nil, fmt.Errorf("checkpoint %s lacks the listed information of %s", s.options.Checkpoint, path)
+			}
+		}
+	}
+	return cp, nil
+}
+
+// restore resumes the progress of the checkpoint, returning the entries to process
+// and the completed directories whose time is still to be set, the deepest first
+func (s *Syncer) restore(cp *checkpoint) (entries []string, completed []string) {
+	for path, cl := range cp.Listed {
+		if cl.Source != nil {
+			s.listed.Store(path, cl.Source)
+		}
+		if cl.Target != nil {
+			s.listedTarget.Store(path, cl.Target)
+		}
+	}
+	s.extraneousMu.Lock()
+	for path, count := range cp.Extraneous {
+		s.extraneous[path] = count
+	}
+	s.extraneousMu.Unlock()
+	s.dirsMu.Lock()
+	for path, cd := range cp.Dirs {
+		dp := &dirProgress{pending: cd.Pending, modified: cd.Modified, targetTime: cd.TargetTime}
+		if cd.Pending > 0 {
+			s.dirs[path] = dp
+		} else {
+			s.completedDirs[path] = dp
+			completed = append(completed, path)
+		}
+	}
+	for path, t := range cp.DirTimes {
+		s.dirTimes[path] = t
+	}
+	s.dirsMu.Unlock()
+	sort.Slice(completed, func(i, j int) bool { return len(completed[i]) > len(completed[j]) })
+	return cp.Pending, completed
+}
+
+func (s *Syncer) removeCheckpoint() error {
+	if err := os.Remove(s.options.Checkpoint); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
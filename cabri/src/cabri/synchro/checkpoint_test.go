@@ -0,0 +1,171 @@
+package synchro
+
+import (
+	"cabri/client"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"testing"
+	"time"
+)
+
+func newCheckpointSyncer(t *testing.T, fileName string) *Syncer {
+	t.Helper()
+	s, err := New(Options{
+		SourceUrl:       "http://source/fscabri/a",
+		TargetUrl:       "http://target/fscabri/b",
+		ListWorkers:     1,
+		TransferWorkers: 1,
+		Checkpoint:      fileName,
+		Resume:          true,
+	})
+	if err != nil {
+		t.Fatalf("New: %v", err)
+	}
+	return s
+}
+
+func TestCheckpointRoundTrip(t *testing.T) {
+	fileName := filepath.Join(t.TempDir(), "checkpoint")
+	s := newCheckpointSyncer(t, fileName)
+	modTime := time.Date(2026, 10, 19, 12, 0, 0, 0, time.UTC)
+	q := newWorkQueue()
+	q.push("T", "/d/", "/d/e/", "/d/f", "/g")
+	if entry, _ := q.pull("T", false); entry != "/d/f" {
+		t.Fatalf("pulled %q, expected /d/f", entry)
+	}
+	s.listed.Store("/d/f", &client.Info{Path: "/d/f", Size: 3, LastModified: modTime})
+	s.listedTarget.Store("/d/f", &client.Info{Path: "/d/f", Size: 4, LastModified: modTime})
+	s.listed.Store("/g", &client.Info{Path: "/g", Size: 5, LastModified: modTime})
+	s.listed.Store("/done", &client.Info{Path: "/done", Size: 6})
+	s.extraneous["/x/"] = 2
+	s.dirs["/d/"] = &dirProgress{pending: 3, modified: true}
+	s.completedDirs["/c/"] = &dirProgress{targetTime: modTime}
+	s.completedDirs["/c/c/"] = &dirProgress{modified: true}
+	s.dirTimes["/d/"] = modTime
+	if err := s.writeCheckpoint(s.snapshot(q)); err != nil {
+		t.Fatalf("writeCheckpoint: %v", err)
+	}
+
+	r := newCheckpointSyncer(t, fileName)
+	cp, err := r.readCheckpoint()
+	if err != nil || cp == nil {
+		t.Fatalf("readCheckpoint: %v %v", cp, err)
+	}
+	entries, completed := r.restore(cp)
+	if expected := []string{"/d/", "/d/e/", "/d/f", "/g"}; !reflect.DeepEqual(entries, expected) {
+		t.Errorf("entries %q, expected %q", entries, expected)
+	}
+	if expected := []string{"/c/c/", "/c/"}; !reflect.DeepEqual(completed, expected) {
+		t.Errorf("completed %q, expected the deepest first %q", completed, expected)
+	}
+	source, target := r.sides()
+	if info := source.info("/d/f"); info == nil || info.Size != 3 || !info.LastModified.Equal(modTime) {
+		t.Errorf("source info of /d/f %+v", info)
+	}
+	if info := target.info("/d/f"); info == nil || info.Size != 4 {
+		t.Errorf("target info of /d/f %+v", info)
+	}
+	if info := source.info("/g"); info == nil || info.Size != 5 {
+		t.Errorf("source info of /g %+v", info)
+	}
+	if target.info("/g") != nil || source.info("/done") != nil {
+		t.Errorf("information restored for absent or processed files")
+	}
+	if !reflect.DeepEqual(r.extraneous, map[string]int{"/x/": 2}) {
+		t.Errorf("extraneous %v", r.extraneous)
+	}
+	if dp := r.dirs["/d/"]; len(r.dirs) != 1 || dp == nil || dp.pending != 3 || !dp.modified {
+		t.Errorf("dirs %v", r.dirs)
+	}
+	if dp := r.completedDirs["/c/"]; len(r.completedDirs) != 2 || dp == nil || !dp.targetTime.Equal(modTime) {
+		t.Errorf("completed dirs %v", r.completedDirs)
+	}
+	if len(r.dirTimes) != 1 || !r.dirTimes["/d/"].Equal(modTime) {
+		t.Errorf("dir times %v", r.dirTimes)
+	}
+}
+
+func TestCheckpointOtherUrls(t *testing.T) {
+	fileName := filepath.Join(t.TempDir(), "checkpoint")
+	s := newCheckpointSyncer(t, fileName)
+	if cp, err := s.readCheckpoint(); cp != nil || err != nil {
+		t.Fatalf("readCheckpoint without file: %v %v", cp, err)
+	}
+	if err := s.writeCheckpoint(s.snapshot(nil)); err != nil {
+		t.Fatalf("writeCheckpoint: %v", err)
+	}
+	s.options.TargetUrl = "http://target/fscabri/c"
+	if _, err := s.readCheckpoint(); err == nil {
+		t.Errorf("no error for a checkpoint of other URLs")
+	}
+}
+
+// TestResumeOrder checks that the resumed entries are pulled in the order of the checkpoint,
+// directories and contents apart, whatever the order they were pending in
+func TestResumeOrder(t *testing.T) {
+	fileName := filepath.Join(t.TempDir(), "checkpoint")
+	s := newCheckpointSyncer(t, fileName)
+	q := newWorkQueue()
+	q.push("T", "/z", "/b/", "/a/c/", "/m", "/a/")
+	if err := s.writeCheckpoint(s.snapshot(q)); err != nil {
+		t.Fatalf("writeCheckpoint: %v", err)
+	}
+	r := newCheckpointSyncer(t, fileName)
+	cp, err := r.readCheckpoint()
+	if err != nil {
+		t.Fatalf("readCheckpoint: %v", err)
+	}
+	entries, _ := r.restore(cp)
+	if !sort.StringsAreSorted(entries) {
+		t.Errorf("entries %q not sorted", entries)
+	}
+	resumed := newWorkQueue()
+	resumed.push("T", entries...)
+	var dirs, contents []string
+	for _, d := range []bool{true, true, true, false, false} {
+		entry, ok := resumed.pull("T", d)
+		if !ok {
+			t.Fatalf("queue exhausted")
+		}
+		if d {
+			dirs = append(dirs, entry)
+		} else {
+			contents = append(contents, entry)
+		}
+		resumed.complete("T", entry)
+	}
+	if expected := []string{"/a/", "/a/c/", "/b/"}; !reflect.DeepEqual(dirs, expected) {
+		t.Errorf("directories %q, expected the parents first %q", dirs, expected)
+	}
+	if expected := []string{"/m", "/z"}; !reflect.DeepEqual(contents, expected) {
+		t.Errorf("contents %q, expected %q", contents, expected)
+	}
+}
+
+func TestCheckpointWithoutListed(t *testing.T) {
+	fileName := filepath.Join(t.TempDir(), "checkpoint")
+	s := newCheckpointSyncer(t, fileName)
+	q := newWorkQueue()
+	q.push("T", "/d/", "/f", "/g")
+	s.listed.Store("/f", &client.Info{Path: "/f", Size: 3})
+	if err := s.writeCheckpoint(s.snapshot(q)); err != nil {
+		t.Fatalf("writeCheckpoint: %v", err)
+	}
+	if _, err := s.readCheckpoint(); err != nil {
+		t.Errorf("readCheckpoint of a synchronization: %v", err)
+	}
+	for _, options := range []Options{{Verify: true}, {Bidirectional: true}} {
+		s.options.Verify, s.options.Bidirectional = options.Verify, options.Bidirectional
+		if _, err := s.readCheckpoint(); err == nil {
+			t.Errorf("no error for the unlisted /g, verify %v bidirectional %v", options.Verify, options.Bidirectional)
+		}
+	}
+	s.listedTarget.Store("/g", &client.Info{Path: "/g", Size: 4})
+	if err := s.writeCheckpoint(s.snapshot(q)); err != nil {
+		t.Fatalf("writeCheckpoint: %v", err)
+	}
+	if _, err := s.readCheckpoint(); err != nil {
+		t.Errorf("readCheckpoint with all the files listed: %v", err)
+	}
+}
@@ -0,0 +1,162 @@
+package synchro
+
+import (
+	"cabri/client"
+	"context"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// CompareMode tells how a file is found unchanged and not copied
+type CompareMode string
+
+const (
+	CompareChecksum  CompareMode = "checksum"
+	CompareSizeMtime CompareMode = "size+mtime"
+	CompareSizeOnly  CompareMode = "size-only"
+	CompareAlways    CompareMode = "always"
+)
+
+// comparison is the outcome of the comparison of a source file with the target one
+type comparison struct {
+	same       bool
+	reason     string
+	source     *client.Info
+	sourceSize int64
+	targetSize int64
+}
+
+// metadataCompare tells whether the files are compared with the listing metadata
+func (s *Syncer) metadataCompare() bool {
+	return s.options.Compare == CompareSizeMtime || s.options.Compare == CompareSizeOnly
+}
+
+func (s *Syncer) compareContent(ctx context.Context, id string, path string) (cmp comparison, err error) {
+	switch s.options.Compare {
+	case CompareAlways:
+		return comparison{reason: "always copied", sourceSize: -1, targetSize: -1}, nil
+	case CompareSizeMtime, CompareSizeOnly:
+		return s.compareMetadata(ctx, id, path, s.options.Compare == CompareSizeMtime)
+	}
+	return s.compareChecksum(ctx, id, path)
+}
+
+// compareChecksum compares the checksums returned by HEAD requests, computed by the servers
+func (s *Syncer) compareChecksum(ctx context.Context, id string, path string) (cmp comparison, err error) {
+	var info *client.Info
+	var targetCs string
+	cmp.sourceSize, cmp.targetSize = -1, -1
+	err = s.retry(ctx, "synchroContent: head target", path, func() (err error) {
+		info, err = s.headEntry(ctx, s.target, path)
+		return
+	})
+	if err != nil {
+		logrus.WithField("path", path).WithError(err).Error("synchroContent: head target")
+		return
+	}
+	if info != nil {
+		targetCs = info.Checksum
+		cmp.targetSize = info.Size
+		logrus.Debugf("synchroContent%s %s exists Checksum %s", id, path, targetCs)
+	}
+	cmp.reason = "absent from target"
+	if targetCs != "" {
+		cmp.reason = "checksum differs"
+	}
+
+	if targetCs != "" || s.options.DryRun {
+		err = s.retry(ctx, "synchroContent: head source", path, func() (err error) {
+			info, err = s.headEntry(ctx, s.source, path)
+			return
+		})
+		if err != nil {
+			logrus.WithField("path", path).WithError(err).Error("synchroContent: head source")
+			return
+		}
+		if info != nil {
+			cmp.sourceSize = info.Size
+			if targetCs != "" && info.Checksum == targetCs {
+				logrus.Debugf("synchroContent%s %s exists with same Checksum %s", id, path, targetCs)
+				cmp.same, cmp.reason, cmp.source = true, "same checksum", info
+			}
+		}
+	}
+	return
+}
+
+// compareMetadata compares the sizes and, if mtime, the modification times,
+// taken from the listings or from HEAD requests when the listings lack them
+func (s *Syncer) compareMetadata(ctx context.Context, id string, path string, mtime bool) (cmp comparison, err error) {
+	var src, tgt *client.Info
+	if src, err = s.contentInfo(ctx, s.source, &s.listed, path, mtime); err != nil {
+		logrus.WithField("path", path).WithError(err).Error("synchroContent: head source")
+		return
+	}
+	if tgt, err = s.contentInfo(ctx, s.target, &s.listedTarget, path, mtime); err != nil {
+		logrus.WithField("path", path).WithError(err).Error("synchroContent: head target")
+		return
+	}
+	cmp.source, cmp.sourceSize, cmp.targetSize = src, -1, -1
+	if src != nil {
+		cmp.sourceSize = src.Size
+	}
+	if tgt != nil {
+		cmp.targetSize = tgt.Size
+	}
+	switch {
+	case tgt == nil:
+		cmp.reason = "absent from target"
+	case src == nil || src.Size != tgt.Size:
+		cmp.reason = "size differs"
+	case mtime && !src.LastModified.Truncate(time.Second).Equal(tgt.LastModified.Truncate(time.Second)):
+		cmp.reason = "mtime differs"
+	case mtime:
+		cmp.same, cmp.reason = true, "same size and mtime"
+	default:
+		cmp.same, cmp.reason = true, "same size"
+	}
+	logrus.Debugf("synchroContent%s %s %s", id, path, cmp.reason)
+	return
+}
+
+// contentInfo returns the listed information of a file, nil if absent from its listed directory,
+// or the information returned by HEAD if the listing lacks it
+func (s *Syncer) contentInfo(ctx context.Context, c *client.Client, listed *sync.Map, path string, mtime bool) (info *client.Info, err error) {
+	if li, ok := listed.Load(path); ok {
+		info = li.(*client.Info)
+		if info.Size >= 0 && (!mtime || !info.LastModified.IsZero()) {
+			return
+		}
+	} else if _, ok := listed.Load(path[:strings.LastIndex(path, "/")+1]); ok {
+		return nil, nil
+	}
+	err = s.retry(ctx, "synchroContent: head", path, func() (err error) {
+		info, err = s.headEntry(ctx, c, path)
+		return
+	})
+	return
+}
+
+// listTarget keeps the metadata of the files of a target directory, and the directory itself
+// to tell that a file not listed is absent
+func (s *Syncer) listTarget(ctx context.Context, id string, path string) {
+	var infos []*client.Info
+	err := s.retry(ctx, "synchroDir: list target", path, func() (err error) {
+		infos, err = s.target.ListInfo(ctx, path)
+		return
+	})
+	if err != nil {
+		logrus.WithField("path", path).WithError(err).Error("synchroDir: list target")
+		return
+	}
+	logrus.Debugf("listTarget%s %s %d entries", id, path, len(infos))
+	for _, info := range infos {
+		if !info.IsDir {
+			s.listedTarget.Store(info.Path, info)
+		}
+	}
+	s.listedTarget.Store(path, &client.Info{Path: path, IsDir: true})
+}
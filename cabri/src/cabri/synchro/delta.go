@@ -0,0 +1,83 @@
+package synchro
+
+import (
+	"cabri/client"
+	"cabri/delta"
+	"context"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+
+	"github.com/sirupsen/logrus"
+)
+
+var errNoDelta = errors.New("delta transfer not possible")
+
+func (s *Syncer) deltaSupported(c *client.Client) bool {
+	_, unsupported := s.deltaUnsupported.Load(c.BaseUrl())
+	return !unsupported
+}
+
+// deltaContent sends to the target only the differences of the source content with the target one,
+// computed against the target signature, the error matching errNoDelta when a full copy is needed
+func (s *Syncer) deltaContent(ctx context.Context, id string, from *client.Client, to *client.Client, fromPath string, toPath string, baseSize int64) (info *client.Info, sent int64, err error) {
+	var sig *delta.Signature
+	var base *client.Info
+	sig, base, err = to.Signature(ctx, toPath, delta.BlockSize(baseSize))
+	if errors.Is(err, client.ErrUnsupported) {
+		logrus.Infof("synchro: %s does not support delta transfers", to.BaseUrl())
+		s.deltaUnsupported.Store(to.BaseUrl(), true)
+		return nil, 0, fmt.Errorf("%v: %w", err, errNoDelta)
+	}
+	if errors.Is(err, client.ErrNotFound) {
+		return nil, 0, fmt.Errorf("%v: %w", err, errNoDelta)
+	}
+	if err != nil {
+		return
+	}
+
+	var content io.ReadCloser
+	if content, info, err = from.Get(ctx, fromPath); err != nil {
+		return
+	}
+	defer content.Close()
+	h := sha256.New()
+	counter := &countingReader{r: io.TeeReader(s.throttle(ctx, content), h)}
+	pr, pw := io.Pipe()
+	defer pr.Close()
+	encoded := make(chan error, 1)
+	go func() {
+		err := delta.Encode(pw, sig, counter)
+		pw.CloseWithError(err)
+		encoded <- err
+	}()
+	patch := &countingReader{r: pr}
+
+	logrus.Debugf("deltaContent%s %s patch %s%s of %d bytes", id, fromPath, to.BaseUrl(), toPath, sig.Size)
+	var targetCs string
+	targetCs, err = to.PutPatch(ctx, toPath, patch, sig.BlockSize, base.LastModified, info.LastModified)
+	var se *client.StatusError
+	if errors.As(err, &se) && (se.Status == http.StatusPreconditionFailed || se.Status == http.StatusNotFound || se.Status == http.StatusBadRequest) {
+		return nil, 0, fmt.Errorf("%v: %w", err, errNoDelta)
+	}
+	if err != nil {
+		return
+	}
+	if err = <-encoded; err != nil {
+		return
+	}
+	info.Size = counter.n
+	info.Checksum = fmt.Sprintf("%x", h.Sum(nil))
+	if targetCs != info.Checksum {
+		return nil, 0, fmt.Errorf("patch checksum mismatch, expected %s, target %s: %w", info.Checksum, targetCs, errNoDelta)
+	}
+	sent = patch.n
+	logrus.Debugf("deltaContent%s %s sent %d bytes for %d", id, fromPath, sent, info.Size)
+	s.countStat(func(r *Report) {
+		r.FilesPatched++
+		r.BytesSaved += info.Size - sent
+	})
+	return
+}
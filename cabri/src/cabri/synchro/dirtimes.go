@@ -0,0 +1,165 @@
+package synchro
+
+import (
+	"cabri/client"
+	"context"
+	"errors"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// dirProgress counts the entries of a target directory not processed yet, plus one for the directory itself,
+// so that its modification time is set once nothing modifies it anymore
+type dirProgress struct {
+	pending    int
+	modified   bool
+	targetTime time.Time
+}
+
+func (s *Syncer) dirTimesEnabled() bool {
+	return !s.options.DryRun && !s.options.Bidirectional && !s.options.Verify
+}
+
+func parentDir(path string) string {
+	return path[:strings.LastIndex(path[:len(path)-1], "/")+1]
+}
+
+// expectEntries records the entries of a directory to process before setting its time,
+// and its current modification time on the target, zero if it was created
+func (s *Syncer) expectEntries(path string, count int, targetTime time.Time) {
+	if !s.dirTimesEnabled() {
+		return
+	}
+	s.dirsMu.Lock()
+	defer s.dirsMu.Unlock()
+	s.dirs[path] = &dirProgress{pending: count + 1, modified: targetTime.IsZero(), targetTime: targetTime}
+}
+
+// dirModified records that the content of a target directory changed
+func (s *Syncer) dirModified(path string) {
+	if !s.dirTimesEnabled() {
+		return
+	}
+	s.dirsMu.Lock()
+	defer s.dirsMu.Unlock()
+	if dp, ok := s.dirs[path]; ok {
+		dp.modified = true
+	}
+}
+
+// entryDone records that an entry is processed, a listed directory waiting for its entries,
+// and returns the directories it completes, whose time is to be set by setDirTimes
+func (s *Syncer) entryDone(path string, listed bool) (completed []string) {
+	if !s.dirTimesEnabled() {
+		return
+	}
+	s.dirsMu.Lock()
+	defer s.dirsMu.Unlock()
+	if !listed && path != "/" {
+		path = parentDir(path)
+	}
+	for {
+		dp, ok := s.dirs[path]
+		if !ok {
+			break
+		}
+		dp.pending--
+		if dp.pending > 0 {
+			break
+		}
+		delete(s.dirs, path)
+		s.completedDirs[path] = dp
+		completed = append(completed, path)
+		if path == "/" {
+			break
+		}
+		path = parentDir(path)
+	}
+	return
+}
+
+// setDirTimes sets the time of completed directories, the deepest first
+func (s *Syncer) setDirTimes(ctx context.Context, completed []string) {
+	for _, path := range completed {
+		s.dirsMu.Lock()
+		dp := s.completedDirs[path]
+		s.dirsMu.Unlock()
+		if dp != nil {
+			s.setDirTime(ctx, path, dp)
+		}
+		s.dirsMu.Lock()
+		delete(s.completedDirs, path)
+		s.dirsMu.Unlock()
+	}
+}
+
+// setDirTime sets the modification time of the target directory to the source one,
+// unless the source one is unknown or the target directory already has it
+func (s *Syncer) setDirTime(ctx context.Context, path string, dp *dirProgress) {
+	info := s.listedInfo(path)
+	if info == nil || info.LastModified.IsZero() {
+		if atomic.LoadInt32(&s.noSourceDirTimes) != 0 {
+			return
+		}
+		err := s.retry(ctx, "setDirTime: head source", path, func() (err error) {
+			info, err = s.headEntry(ctx, s.source, path)
+			return
+		})
+		if errors.Is(err, client.ErrUnsupported) {
+			if atomic.CompareAndSwapInt32(&s.noSourceDirTimes, 0, 1) {
+				logrus.Infof("synchro: %s does not tell the directory times", s.source.BaseUrl())
+			}
+			return
+		}
+		if err != nil {
+			logrus.WithField("path", path).WithError(err).Error("setDirTime: head source")
+			return
+		}
+	}
+	if info == nil || info.LastModified.IsZero() {
+		return
+	}
+	lastModified := info.LastModified
+	s.dirsMu.Lock()
+	s.dirTimes[path] = lastModified
+	s.dirsMu.Unlock()
+	if !dp.modified && dp.targetTime.Truncate(time.Second).Equal(lastModified.Truncate(time.Second)) {
+		return
+	}
+	err := s.retry(ctx, "setDirTime: put", path, func() error {
+		return s.target.MkdirTime(ctx, path, lastModified)
+	})
+	if err != nil {
+		logrus.WithField("path", path).WithError(err).Error("setDirTime: put")
+		return
+	}
+	logrus.Debugf("setDirTime %s %v", path, lastModified)
+}
+
+// restoreDirTimes sets again the time of the parent directories of deleted entries,
+// known once all the directories are processed
+func (s *Syncer) restoreDirTimes(ctx context.Context, deleted []string) {
+	if !s.dirTimesEnabled() {
+		return
+	}
+	restored := make(map[string]bool)
+	for _, path := range deleted {
+		parent := parentDir(path)
+		s.dirsMu.Lock()
+		lastModified, ok := s.dirTimes[parent]
+		s.dirsMu.Unlock()
+		if !ok || restored[parent] {
+			continue
+		}
+		restored[parent] = true
+		err := s.retry(ctx, "restoreDirTimes: put", parent, func() error {
+			return s.target.MkdirTime(ctx, parent, lastModified)
+		})
+		if err != nil {
+			logrus.WithField("path", parent).WithError(err).Error("restoreDirTimes: put")
+		}
+	}
+}
@@ -0,0 +1,130 @@
+package synchro
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"path"
+	"strings"
+
+	"github.com/sirupsen/logrus"
+)
+
+// FilterRule matches entry paths relative to the synchronized root:
+// a leading "/" anchors the pattern at the root, otherwise it matches at any depth,
+// a trailing "/" matches only directories and "**" matches any number of path segments
+type FilterRule struct {
+	include  bool
+	pattern  string
+	segments []string
+	dirOnly  bool
+}
+
+func NewFilterRule(include bool, pattern string) (rule FilterRule, err error) {
+	rule = FilterRule{include: include, pattern: pattern}
+	p := pattern
+	if strings.HasSuffix(p, "/") {
+		rule.dirOnly = true
+		p = strings.TrimRight(p, "/")
+	}
+	anchored := strings.HasPrefix(p, "/")
+	p = strings.TrimLeft(p, "/")
+	if p == "" {
+		return rule, fmt.Errorf("empty filter pattern %q", pattern)
+	}
+	rule.segments = strings.Split(p, "/")
+	if !anchored {
+		rule.segments = append([]string{"**"}, rule.segments...)
+	}
+	for _, segment := range rule.segments {
+		if _, err = path.Match(segment, ""); err != nil {
+			return rule, fmt.Errorf("invalid filter pattern %q: %v", pattern, err)
+		}
+	}
+	return
+}
+
+func matchSegments(pattern []string, name []string) bool {
+	if len(pattern) == 0 {
+		return len(name) == 0
+	}
+	if pattern[0] == "**" {
+		for i := 0; i <= len(name); i++ {
+			if matchSegments(pattern[1:], name[i:]) {
+				return true
+			}
+		}
+		return false
+	}
+	if len(name) == 0 {
+		return false
+	}
+	if ok, _ := path.Match(pattern[0], name[0]); !ok {
+		return false
+	}
+	return matchSegments(pattern[1:], name[1:])
+}
+
+// Match tells whether entry, a path relative to the synchronized root, matches the rule
+func (rule FilterRule) Match(entry string) bool {
+	if rule.dirOnly && !isDir(entry) {
+		return false
+	}
+	return matchSegments(rule.segments, strings.Split(strings.Trim(entry, "/"), "/"))
+}
+
+// excluded applies the first rule matching entry, entries matching no rule being included
+func (s *Syncer) excluded(entry string) bool {
+	for _, rule := range s.options.Filters {
+		if rule.Match(entry) {
+			logrus.Debugf("excluded %s matches %v %s", entry, !rule.include, rule.pattern)
+			return !rule.include
+		}
+	}
+	return false
+}
+
+func (s *Syncer) filterEntries(entries []string) (kept []string) {
+	for _, entry := range entries {
+		if s.excluded(entry) {
+			if s.options.DryRun {
+				s.addPlan("skip", entry, "excluded", 0)
+			}
+			continue
+		}
+		kept = append(kept, entry)
+	}
+	return
+}
+
+// ReadFilterFile reads rules from a file, one per line,
+// "+ pattern" to include, "- pattern" to exclude, "#" starting a comment
+func ReadFilterFile(fileName string) (rules []FilterRule, err error) {
+	file, err := os.Open(fileName)
+	if err != nil {
+		return
+	}
+	defer file.Close()
+	scanner := bufio.NewScanner(file)
+	for lineNum := 1; scanner.Scan(); lineNum++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		var include bool
+		switch {
+		case strings.HasPrefix(line, "+ "):
+			include = true
+		case strings.HasPrefix(line, "- "):
+			include = false
+		default:
+			return nil, fmt.Errorf("%s:%d: rule must start with \"+ \" or \"- \"", fileName, lineNum)
+		}
+		rule, err := NewFilterRule(include, strings.TrimSpace(line[2:]))
+		if err != nil {
+			return nil, fmt.Errorf("%s:%d: %v", fileName, lineNum, err)
+		}
+		rules = append(rules, rule)
+	}
+	return rules, scanner.Err()
+}
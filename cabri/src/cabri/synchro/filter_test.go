@@ -0,0 +1,151 @@
+package synchro
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestMatchSegments(t *testing.T) {
+	tests := []struct {
+		pattern string
+		name    string
+		match   bool
+	}{
+		{"**", "", true},
+		{"**", "a/b/c", true},
+		{"**/c", "c", true},
+		{"**/c", "a/b/c", true},
+		{"**/c", "a/b/c/d", false},
+		{"a/**", "a", true},
+		{"a/**", "a/b/c", true},
+		{"a/**", "b/a", false},
+		{"**/b/**", "b", true},
+		{"**/b/**", "a/b/c", true},
+		{"**/b/**", "a/bb/c", false},
+		{"a/**/d", "a/d", true},
+		{"a/**/d", "a/b/c/d", true},
+		{"a/**/d", "a/b/c", false},
+		{"a/*.go", "a/x.go", true},
+		{"a/*.go", "a/b/x.go", false},
+		{"a/b", "a", false},
+		{"a", "a/b", false},
+	}
+	for _, test := range tests {
+		pattern := strings.Split(test.pattern, "/")
+		name := strings.Split(test.name, "/")
+		if test.name == "" {
+			name = nil
+		}
+		if match := matchSegments(pattern, name); match != test.match {
+			t.Errorf("matchSegments(%q, %q) = %v, expected %v", test.pattern, test.name, match, test.match)
+		}
+	}
+}
+
+func TestFilterRuleMatch(t *testing.T) {
+	tests := []struct {
+		pattern string
+		entry   string
+		match   bool
+	}{
+		{"*.tmp", "x.tmp", true},
+		{"*.tmp", "a/b/x.tmp", true},
+		{"*.tmp", "a/x.tmp/", true},
+		{"/*.tmp", "x.tmp", true},
+		{"/*.tmp", "a/x.tmp", false},
+		{"/a/b", "a/b", true},
+		{"/a/b", "c/a/b", false},
+		{"a/b", "c/a/b", true},
+		{"**/build", "build/", true},
+		{"**/build", "x/y/build", true},
+		{"/a/**", "a/", true},
+		{"/a/**", "a/b/c", true},
+		{"/a/**", "b/a/c", false},
+		{"/a/**/x", "a/x", true},
+		{"/a/**/x", "a/b/c/x", true},
+		{"cache/", "cache/", true},
+		{"cache/", "cache", false},
+		{"cache/", "a/cache/", true},
+		{"/cache/", "a/cache/", false},
+		{"**/", "a/b/", true},
+		{"**/", "a/b", false},
+	}
+	for _, test := range tests {
+		rule, err := NewFilterRule(false, test.pattern)
+		if err != nil {
+			t.Fatalf("NewFilterRule(%q): %v", test.pattern, err)
+		}
+		if match := rule.Match(test.entry); match != test.match {
+			t.Errorf("%q matching %q = %v, expected %v", test.pattern, test.entry, match, test.match)
+		}
+	}
+}
+
+func TestNewFilterRuleInvalid(t *testing.T) {
+	for _, pattern := range []string{"", "/", "//", "a/[b"} {
+		if _, err := NewFilterRule(true, pattern); err == nil {
+			t.Errorf("no error for the pattern %q", pattern)
+		}
+	}
+}
+
+func TestExcludedFirstMatchWins(t *testing.T) {
+	rules := []struct {
+		include bool
+		pattern string
+	}{
+		{true, "/keep/*.log"},
+		{false, "*.log"},
+		{false, "tmp/"},
+		{true, "tmp"},
+	}
+	var filters []FilterRule
+	for _, r := range rules {
+		rule, err := NewFilterRule(r.include, r.pattern)
+		if err != nil {
+			t.Fatalf("NewFilterRule(%q): %v", r.pattern, err)
+		}
+		filters = append(filters, rule)
+	}
+	s := &Syncer{options: Options{Filters: filters}}
+	tests := []struct {
+		entry    string
+		excluded bool
+	}{
+		{"keep/a.log", false},
+		{"a.log", true},
+		{"other/keep/a.log", true},
+		{"tmp/", true},
+		{"a/tmp/", true},
+		{"tmp", false},
+		{"a.txt", false},
+	}
+	for _, test := range tests {
+		if excluded := s.excluded(test.entry); excluded != test.excluded {
+			t.Errorf("excluded(%q) = %v, expected %v", test.entry, excluded, test.excluded)
+		}
+	}
+}
+
+func TestReadFilterFile(t *testing.T) {
+	fileName := filepath.Join(t.TempDir(), "filters")
+	content := "# comment\n\n+ /keep/\n-   *.tmp  \n"
+	if err := os.WriteFile(fileName, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+	rules, err := ReadFilterFile(fileName)
+	if err != nil {
+		t.Fatalf("ReadFilterFile: %v", err)
+	}
+	if len(rules) != 2 || !rules[0].include || rules[0].pattern != "/keep/" || rules[1].include || rules[1].pattern != "*.tmp" {
+		t.Errorf("rules %+v", rules)
+	}
+	if err = os.WriteFile(fileName, []byte("+ a\n* b\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = ReadFilterFile(fileName); err == nil || !strings.Contains(err.Error(), ":2:") {
+		t.Errorf("error %v, expected one on line 2", err)
+	}
+}
@@ -0,0 +1,134 @@
+package synchro
+
+import (
+	"cabri/client"
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+
+	"github.com/sirupsen/logrus"
+)
+
+// findExtraneous records the target entries of path absent from the source,
+// with the number of entries their deletion would remove, -1 when it is unknown
+func (s *Syncer) findExtraneous(ctx context.Context, id string, path string, sourceEntries []string) error {
+	var targetEntries []string
+	err := s.retry(ctx, "findExtraneous: list", path, func() (err error) {
+		targetEntries, err = s.listDir(ctx, id, s.target, path)
+		return
+	})
+	if err != nil {
+		return fmt.Errorf("findExtraneous: list: %s: %w", path, err)
+	}
+	inSource := make(map[string]bool, len(sourceEntries))
+	for _, entry := range sourceEntries {
+		inSource[entry] = true
+	}
+	for _, entry := range targetEntries {
+		if inSource[entry] || s.excluded(entry) {
+			continue
+		}
+		count := 1
+		if isDir(entry) {
+			n, err := s.countEntries(ctx, id, entry)
+			if err != nil {
+				logrus.WithField("path", entry).WithError(err).Error("findExtraneous")
+				s.countStat(func(r *Report) { r.DirsFailed++ })
+				s.emit(Event{Kind: EventFailure, Path: entry, Err: err})
+				n, count = 0, -1
+			}
+			count += n
+		}
+		logrus.Debugf("findExtraneous%s %s (%d entries)", id, entry, count)
+		s.extraneousMu.Lock()
+		s.extraneous[entry] = count
+		s.extraneousMu.Unlock()
+	}
+	return nil
+}
+
+func (s *Syncer) countEntries(ctx context.Context, id string, path string) (count int, err error) {
+	var entries []string
+	err = s.retry(ctx, "countEntries: list", path, func() (err error) {
+		entries, err = s.listDir(ctx, id, s.target, path)
+		return
+	})
+	if err != nil {
+		return 0, fmt.Errorf("countEntries: list: %s: %w", path, err)
+	}
+	for _, entry := range entries {
+		count++
+		if isDir(entry) {
+			var n int
+			if n, err = s.countEntries(ctx, id, entry); err != nil {
+				return
+			}
+			count += n
+		}
+	}
+	return
+}
+
+func (s *Syncer) deleteExtraneous(ctx context.Context) error {
+	s.extraneousMu.Lock()
+	defer s.extraneousMu.Unlock()
+	total := 0
+	uncounted := 0
+	paths := make([]string, 0, len(s.extraneous))
+	for path, count := range s.extraneous {
+		if count < 0 {
+			uncounted++
+		}
+		total += count
+		paths = append(paths, path)
+	}
+	// the deletion of a directory whose entries could not be counted could exceed max-delete
+	if s.options.MaxDelete >= 0 && uncounted > 0 {
+		s.countStat(func(r *Report) { r.DeleteAborted = true })
+		return fmt.Errorf("%d directories to delete could not be counted", uncounted)
+	}
+	if s.options.MaxDelete >= 0 && total > s.options.MaxDelete {
+		s.countStat(func(r *Report) { r.DeleteAborted = true })
+		return fmt.Errorf("%d entries would be deleted, more than max-delete %d", total, s.options.MaxDelete)
+	}
+	sort.Strings(paths)
+	if s.options.DryRun {
+		for _, path := range paths {
+			reason := fmt.Sprintf("absent from source, %d entries", s.extraneous[path])
+			if s.extraneous[path] < 0 {
+				reason = "absent from source, entries not counted"
+			}
+			s.addPlan("delete", path, reason, 0)
+		}
+		return nil
+	}
+	failed := 0
+	var deleted []string
+	for _, path := range paths {
+		err := s.retry(ctx, "deleteExtraneous: delete", path, func() error {
+			// already deleted by an interrupted run
+			if err := s.target.Delete(ctx, path, true); !errors.Is(err, client.ErrNotFound) {
+				return err
+			}
+			return nil
+		})
+		if err != nil {
+			logrus.WithField("path", path).WithError(err).Error("deleteExtraneous: delete")
+			failed++
+			s.countStat(func(r *Report) { r.DeletesFailed++ })
+			s.emit(Event{Kind: EventFailure, Path: path, Err: err})
+			continue
+		}
+		logrus.WithField("path", path).Info("delete")
+		deleted = append(deleted, path)
+		s.forgetState(path)
+		s.countStat(func(r *Report) { r.Deleted++ })
+		s.emit(Event{Kind: EventDelete, Path: path})
+	}
+	s.restoreDirTimes(ctx, deleted)
+	if failed != 0 {
+		return fmt.Errorf("%d deletions failed", failed)
+	}
+	return nil
+}
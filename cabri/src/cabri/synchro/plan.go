@@ -0,0 +1,71 @@
+package synchro
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"sort"
+)
+
+type PlanAction struct {
+	Action string `json:"action"`
+	Path   string `json:"path"`
+	Reason string `json:"reason"`
+	Bytes  int64  `json:"bytes"`
+}
+
+type planTotal struct {
+	Count int   `json:"count"`
+	Bytes int64 `json:"bytes"`
+}
+
+func (s *Syncer) addPlan(action string, path string, reason string, bytes int64) {
+	s.planMu.Lock()
+	defer s.planMu.Unlock()
+	s.plan = append(s.plan, PlanAction{
+		Action: action,
+		Path:   path,
+		Reason: reason,
+		Bytes:  bytes,
+	})
+}
+
+// Plan returns the actions a dry-run would perform, sorted by path
+func (s *Syncer) Plan() []PlanAction {
+	s.planMu.Lock()
+	defer s.planMu.Unlock()
+	plan := append([]PlanAction{}, s.plan...)
+	sort.SliceStable(plan, func(i, j int) bool { return plan[i].Path < plan[j].Path })
+	return plan
+}
+
+// WritePlan writes the plan with its totals per action, format being text or json
+func WritePlan(w io.Writer, plan []PlanAction, format string) error {
+	totals := make(map[string]*planTotal)
+	for _, action := range []string{"mkdir", "put", "delete", "skip"} {
+		totals[action] = &planTotal{}
+	}
+	for _, pa := range plan {
+		totals[pa.Action].Count++
+		if pa.Bytes > 0 {
+			totals[pa.Action].Bytes += pa.Bytes
+		}
+	}
+	if format == "json" {
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		return enc.Encode(struct {
+			Actions []PlanAction          `json:"actions"`
+			Totals  map[string]*planTotal `json:"totals"`
+		}{plan, totals})
+	}
+	for _, pa := range plan {
+		if _, err := fmt.Fprintf(w, "%-6s %s %d bytes (%s)\n", pa.Action, pa.Path, pa.Bytes, pa.Reason); err != nil {
+			return err
+		}
+	}
+	_, err := fmt.Fprintf(w, "mkdir %d, put %d (%d bytes), delete %d, skip %d (%d bytes)\n",
+		totals["mkdir"].Count, totals["put"].Count, totals["put"].Bytes,
+		totals["delete"].Count, totals["skip"].Count, totals["skip"].Bytes)
+	return err
+}
@@ -0,0 +1,127 @@
+package synchro
+
+import (
+	"sort"
+	"sync"
+
+	"github.com/sirupsen/logrus"
+)
+
+// workQueue tracks the outstanding entries, pending or being processed,
+// so that consumers stop exactly when no entry can produce more work,
+// directories and contents being pulled by distinct consumers
+type workQueue struct {
+	mu          sync.Mutex
+	cond        *sync.Cond
+	dirs        []string
+	contents    []string
+	inProgress  map[string]int
+	outstanding int
+	canceled    bool
+}
+
+func newWorkQueue() *workQueue {
+	q := &workQueue{inProgress: make(map[string]int)}
+	q.cond = sync.NewCond(&q.mu)
+	return q
+}
+
+func (q *workQueue) push(id string, entries ...string) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	logrus.Debugf("push %s: %d+%d <- %d", id, len(q.dirs), len(q.contents), len(entries))
+	for _, entry := range entries {
+		if isDir(entry) {
+			q.dirs = append(q.dirs, entry)
+		} else {
+			q.contents = append(q.contents, entry)
+		}
+	}
+	q.outstanding += len(entries)
+	q.cond.Broadcast()
+}
+
+// pull blocks until a directory or a content entry is available,
+// ok is false when all the work is done
+func (q *workQueue) pull(id string, dirs bool) (entry string, ok bool) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	pending := &q.contents
+	if dirs {
+		pending = &q.dirs
+	}
+	for len(*pending) == 0 && q.outstanding > 0 && !q.canceled {
+		q.cond.Wait()
+	}
+	if len(*pending) == 0 || q.canceled {
+		logrus.Debugf("pull %s: all done", id)
+		return "", false
+	}
+	entry = (*pending)[0]
+	*pending = (*pending)[1:]
+	q.inProgress[entry]++
+	logrus.Debugf("pull %s: %d+%d -> %s", id, len(q.dirs), len(q.contents), entry)
+	return entry, true
+}
+
+// complete must be called once an entry pulled is processed,
+// pushing the entries it produced at the same time
+func (q *workQueue) complete(id string, entry string, entries ...string) {
+	q.push(id, entries...)
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.release(entry)
+	q.outstanding--
+	if q.outstanding == 0 {
+		q.cond.Broadcast()
+	}
+}
+
+// interrupt must be called instead of complete when the processing of an entry
+// was interrupted, the entry remaining pending in the snapshots
+func (q *workQueue) interrupt(entry string) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.outstanding--
+	if q.outstanding == 0 {
+		q.cond.Broadcast()
+	}
+}
+
+func (q *workQueue) release(entry string) {
+	if q.inProgress[entry] > 1 {
+		q.inProgress[entry]--
+	} else {
+		delete(q.inProgress, entry)
+	}
+}
+
+// snapshot returns the entries pending or being processed
+func (q *workQueue) snapshot() []string {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	set := make(map[string]bool, len(q.dirs)+len(q.contents)+len(q.inProgress))
+	for _, entry := range q.dirs {
+		set[entry] = true
+	}
+	for _, entry := range q.contents {
+		set[entry] = true
+	}
+	for entry := range q.inProgress {
+		set[entry] = true
+	}
+	entries := make([]string, 0, len(set))
+	for entry := range set {
+		entries = append(entries, entry)
+	}
+	sort.Strings(entries)
+	return entries
+}
+
+// cancel wakes up the consumers, which stop pulling entries
+func (q *workQueue) cancel() {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.canceled = true
+	q.cond.Broadcast()
+}
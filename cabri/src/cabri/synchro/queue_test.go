@@ -0,0 +1,101 @@
+package synchro
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func checkCounts(t *testing.T, q *workQueue, dirs int, contents int, inProgress int, outstanding int) {
+	t.Helper()
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if len(q.dirs) != dirs || len(q.contents) != contents || len(q.inProgress) != inProgress || q.outstanding != outstanding {
+		t.Errorf("%d dirs %d contents %d in progress %d outstanding, expected %d %d %d %d",
+			len(q.dirs), len(q.contents), len(q.inProgress), q.outstanding, dirs, contents, inProgress, outstanding)
+	}
+}
+
+func TestWorkQueueCounts(t *testing.T) {
+	q := newWorkQueue()
+	q.push("T", "/d/", "/f1", "/f2")
+	checkCounts(t, q, 1, 2, 0, 3)
+	dir, ok := q.pull("T", true)
+	if !ok || dir != "/d/" {
+		t.Fatalf("pulled %q %v, expected /d/", dir, ok)
+	}
+	checkCounts(t, q, 0, 2, 1, 3)
+	if snapshot := q.snapshot(); !reflect.DeepEqual(snapshot, []string{"/d/", "/f1", "/f2"}) {
+		t.Errorf("snapshot %q with the directory in progress", snapshot)
+	}
+	q.complete("T", "/d/", "/d/e/", "/d/f3")
+	checkCounts(t, q, 1, 3, 0, 4)
+	content, ok := q.pull("T", false)
+	if !ok || content != "/f1" {
+		t.Fatalf("pulled %q %v, expected /f1", content, ok)
+	}
+	q.interrupt(content)
+	checkCounts(t, q, 1, 2, 1, 3)
+	if snapshot := q.snapshot(); !reflect.DeepEqual(snapshot, []string{"/d/e/", "/d/f3", "/f1", "/f2"}) {
+		t.Errorf("snapshot %q with an interrupted entry", snapshot)
+	}
+}
+
+func TestWorkQueueRequeued(t *testing.T) {
+	q := newWorkQueue()
+	// an entry re-queued while being processed is pulled again before completing
+	q.push("T", "/f", "/f")
+	first, _ := q.pull("T", false)
+	second, _ := q.pull("T", false)
+	checkCounts(t, q, 0, 0, 1, 2)
+	q.complete("T", first)
+	checkCounts(t, q, 0, 0, 1, 1)
+	if snapshot := q.snapshot(); !reflect.DeepEqual(snapshot, []string{"/f"}) {
+		t.Errorf("snapshot %q with the entry still in progress", snapshot)
+	}
+	q.complete("T", second)
+	checkCounts(t, q, 0, 0, 0, 0)
+}
+
+func TestWorkQueueDone(t *testing.T) {
+	q := newWorkQueue()
+	q.push("T", "/d/")
+	done := make(chan bool)
+	go func() {
+		_, ok := q.pull("T", false)
+		done <- ok
+	}()
+	dir, _ := q.pull("T", true)
+	select {
+	case <-done:
+		t.Fatalf("content consumer stopped while a directory is outstanding")
+	case <-time.After(50 * time.Millisecond):
+	}
+	q.complete("T", dir)
+	if ok := <-done; ok {
+		t.Errorf("content consumer pulled an entry from an empty queue")
+	}
+	if _, ok := q.pull("T", true); ok {
+		t.Errorf("directory consumer pulled an entry from an empty queue")
+	}
+}
+
+func TestWorkQueueCancel(t *testing.T) {
+	q := newWorkQueue()
+	q.push("T", "/d/", "/f")
+	done := make(chan bool)
+	go func() {
+		_, ok := q.pull("T", true)
+		done <- ok
+	}()
+	if ok := <-done; !ok {
+		t.Fatalf("no directory pulled")
+	}
+	q.cancel()
+	if _, ok := q.pull("T", false); ok {
+		t.Errorf("content pulled from a canceled queue")
+	}
+	if snapshot := q.snapshot(); !reflect.DeepEqual(snapshot, []string{"/d/", "/f"}) {
+		t.Errorf("snapshot %q of a canceled queue", snapshot)
+	}
+}
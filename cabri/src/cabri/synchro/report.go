@@ -0,0 +1,85 @@
+package synchro
+
+import (
+	"sort"
+	"time"
+)
+
+type Outcome string
+
+const (
+	OutcomeSuccess        Outcome = "success"
+	OutcomePartialFailure Outcome = "partial_failure"
+	OutcomeTotalFailure   Outcome = "total_failure"
+)
+
+type Report struct {
+	Source           string       `json:"source"`
+	Target           string       `json:"target"`
+	Start            time.Time    `json:"start"`
+	End              time.Time    `json:"end"`
+	Duration         float64      `json:"duration_seconds"`
+	DirsListed       int64        `json:"dirs_listed"`
+	DirsCreated      int64        `json:"dirs_created"`
+	DirsFailed       int64        `json:"dirs_failed"`
+	FilesCopied      int64        `json:"files_copied"`
+	FilesSkipped     int64        `json:"files_skipped"`
+	FilesFailed      int64        `json:"files_failed"`
+	Deleted          int64        `json:"deleted"`
+	DeletesFailed    int64        `json:"deletes_failed"`
+	DeleteAborted    bool         `json:"delete_aborted"`
+	Conflicts        int64        `json:"conflicts"`
+	BytesTransferred int64        `json:"bytes_transferred"`
+	FilesPatched     int64        `json:"files_patched"`
+	BytesSaved       int64        `json:"bytes_saved"`
+	Verified         int64        `json:"verified"`
+	Missing          int64        `json:"missing"`
+	Extra            int64        `json:"extra"`
+	Divergent        int64        `json:"divergent"`
+	Divergences      []Divergence `json:"divergences,omitempty"`
+	Throughput       float64      `json:"throughput_bytes_per_second"`
+	Canceled         bool         `json:"canceled"`
+	Outcome          Outcome      `json:"outcome"`
+}
+
+func (s *Syncer) countStat(update func(r *Report)) {
+	s.statsMu.Lock()
+	defer s.statsMu.Unlock()
+	update(&s.stats)
+}
+
+func (s *Syncer) startReport() {
+	s.countStat(func(r *Report) {
+		*r = Report{
+			Source: s.options.SourceUrl,
+			Target: s.options.TargetUrl,
+			Start:  time.Now(),
+		}
+	})
+}
+
+// endReport computes the totals and the outcome: a total failure when nothing succeeded,
+// a partial failure when something failed, diverged or the run was canceled
+func (s *Syncer) endReport(canceled bool) Report {
+	s.statsMu.Lock()
+	defer s.statsMu.Unlock()
+	r := &s.stats
+	r.End = time.Now()
+	r.Duration = r.End.Sub(r.Start).Seconds()
+	if r.Duration > 0 {
+		r.Throughput = float64(r.BytesTransferred) / r.Duration
+	}
+	r.Canceled = canceled
+	failed := r.DirsFailed + r.FilesFailed + r.DeletesFailed
+	succeeded := r.DirsListed + r.FilesCopied + r.FilesSkipped + r.Deleted + r.Verified
+	sort.Slice(r.Divergences, func(i, j int) bool { return r.Divergences[i].Path < r.Divergences[j].Path })
+	switch {
+	case failed > 0 && succeeded == 0:
+		r.Outcome = OutcomeTotalFailure
+	case failed > 0 || r.DeleteAborted || r.Canceled || r.Missing+r.Extra+r.Divergent > 0:
+		r.Outcome = OutcomePartialFailure
+	default:
+		r.Outcome = OutcomeSuccess
+	}
+	return *r
+}
@@ -0,0 +1,69 @@
+package synchro
+
+import (
+	"cabri/client"
+	"context"
+	"errors"
+	"math/rand"
+	"net/http"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// retryable classifies as transient network errors, server errors,
+// timeouts and throttling, other client errors being permanent
+// except 411 which makes the next attempt spool the content to get its length
+func retryable(err error) bool {
+	if errors.Is(err, context.Canceled) || errors.Is(err, client.ErrUnsupported) {
+		return false
+	}
+	var se *client.StatusError
+	if errors.As(err, &se) {
+		return se.Status >= 500 || se.Status == http.StatusTooManyRequests || se.Status == http.StatusRequestTimeout ||
+			se.Status == http.StatusLengthRequired
+	}
+	return true
+}
+
+// backoff returns a delay chosen randomly up to RetryBase * 2^(attempt-1) capped to RetryMax
+func (s *Syncer) backoff(attempt int, err error) time.Duration {
+	retryBase, retryMax := s.options.RetryBase, s.options.RetryMax
+	ceiling := retryMax
+	if shift := uint(attempt - 1); shift < 32 && retryBase<<shift < retryMax {
+		ceiling = retryBase << shift
+	}
+	d := time.Duration(rand.Int63n(int64(ceiling) + 1))
+	var se *client.StatusError
+	if errors.As(err, &se) && se.RetryAfter > d {
+		d = se.RetryAfter
+	}
+	return d
+}
+
+func (s *Syncer) retry(ctx context.Context, op string, path string, f func() error) (err error) {
+	maxAttempts := s.options.Retries
+	for attempt := 1; ; attempt++ {
+		if err = f(); err == nil || !retryable(err) || attempt >= maxAttempts {
+			return
+		}
+		d := s.backoff(attempt, err)
+		logrus.WithFields(logrus.Fields{"path": path, "attempt": attempt, "max_attempts": maxAttempts, "delay": d}).WithError(err).Warnf("%s: retrying", op)
+		s.emit(Event{Kind: EventRetry, Path: path, Reason: op, Err: err})
+		select {
+		case <-time.After(d):
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+func (s *Syncer) requeue(path string) bool {
+	s.requeueMu.Lock()
+	defer s.requeueMu.Unlock()
+	if s.requeued[path] >= s.options.Requeue {
+		return false
+	}
+	s.requeued[path]++
+	return true
+}
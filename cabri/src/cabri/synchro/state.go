@@ -0,0 +1,147 @@
+package synchro
+
+import (
+	"cabri/client"
+	"encoding/json"
+	"strings"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	bolt "go.etcd.io/bbolt"
+)
+
+// State records in a local database, per source and target pair,
+// the size, modification time and checksum of the contents synchronized by the previous runs
+type State struct {
+	db *bolt.DB
+}
+
+// stateEntry records the source modification time, and the target one for a bidirectional synchronization,
+// a directory having a negative size
+type stateEntry struct {
+	Size               int64     `json:"size"`
+	LastModified       time.Time `json:"last_modified"`
+	TargetLastModified time.Time `json:"target_last_modified,omitempty"`
+	Checksum           string    `json:"checksum"`
+}
+
+func OpenState(fileName string) (*State, error) {
+	db, err := bolt.Open(fileName, 0600, &bolt.Options{Timeout: 5 * time.Second})
+	if err != nil {
+		return nil, err
+	}
+	return &State{db: db}, nil
+}
+
+func (st *State) Close() error {
+	return st.db.Close()
+}
+
+func stateBucket(sourceUrl string, targetUrl string, bidirectional bool) []byte {
+	if bidirectional {
+		return []byte("bisync " + sourceUrl + " " + targetUrl)
+	}
+	return []byte(sourceUrl + " " + targetUrl)
+}
+
+func (st *State) get(bucket []byte, path string) (entry *stateEntry, err error) {
+	err = st.db.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket(bucket)
+		if b == nil {
+			return nil
+		}
+		v := b.Get([]byte(path))
+		if v == nil {
+			return nil
+		}
+		entry = &stateEntry{}
+		return json.Unmarshal(v, entry)
+	})
+	return
+}
+
+func (st *State) put(bucket []byte, path string, entry stateEntry) error {
+	v, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+	return st.db.Batch(func(tx *bolt.Tx) error {
+		b, err := tx.CreateBucketIfNotExists(bucket)
+		if err != nil {
+			return err
+		}
+		return b.Put([]byte(path), v)
+	})
+}
+
+// children returns the paths recorded directly under the directory dir
+func (st *State) children(bucket []byte, dir string) (paths []string, err error) {
+	err = st.db.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket(bucket)
+		if b == nil {
+			return nil
+		}
+		c := b.Cursor()
+		for k, _ := c.Seek([]byte(dir)); k != nil && strings.HasPrefix(string(k), dir); k, _ = c.Next() {
+			name := strings.TrimSuffix(string(k)[len(dir):], "/")
+			if name != "" && !strings.Contains(name, "/") {
+				paths = append(paths, string(k))
+			}
+		}
+		return nil
+	})
+	return
+}
+
+// remove forgets path, with the entries under it for a directory
+func (st *State) remove(bucket []byte, path string) error {
+	return st.db.Batch(func(tx *bolt.Tx) error {
+		b := tx.Bucket(bucket)
+		if b == nil {
+			return nil
+		}
+		if !isDir(path) {
+			return b.Delete([]byte(path))
+		}
+		c := b.Cursor()
+		for k, _ := c.Seek([]byte(path)); k != nil && strings.HasPrefix(string(k), path); k, _ = c.Seek([]byte(path)) {
+			if err := c.Delete(); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// unchanged tells whether the content listed with info was synchronized by a previous run
+// and has not been modified since
+func (s *Syncer) unchanged(path string, info *client.Info) bool {
+	if s.options.State == nil || s.options.Full || info == nil || info.Size < 0 || info.LastModified.IsZero() {
+		return false
+	}
+	entry, err := s.options.State.get(s.stateBucket, path)
+	if err != nil {
+		logrus.WithField("path", path).WithError(err).Error("unchanged: state")
+		return false
+	}
+	return entry != nil && entry.Size == info.Size && entry.LastModified.Equal(info.LastModified)
+}
+
+func (s *Syncer) recordState(path string, info *client.Info) {
+	if s.options.State == nil || s.options.DryRun || info == nil || info.LastModified.IsZero() {
+		return
+	}
+	entry := stateEntry{Size: info.Size, LastModified: info.LastModified, Checksum: info.Checksum}
+	if err := s.options.State.put(s.stateBucket, path, entry); err != nil {
+		logrus.WithField("path", path).WithError(err).Error("recordState")
+	}
+}
+
+func (s *Syncer) forgetState(path string) {
+	if s.options.State == nil || s.options.DryRun {
+		return
+	}
+	if err := s.options.State.remove(s.stateBucket, path); err != nil {
+		logrus.WithField("path", path).WithError(err).Error("forgetState")
+	}
+}
@@ -0,0 +1,614 @@
+package synchro
+
+import (
+	"cabri/client"
+	"cabri/tracing"
+	"context"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"go.opentelemetry.io/contrib/instrumentation/net/http/otelhttp"
+	"go.opentelemetry.io/otel/attribute"
+	"golang.org/x/time/rate"
+)
+
+type Options struct {
+	SourceUrl          string
+	TargetUrl          string
+	ListWorkers        int
+	TransferWorkers    int
+	BandwidthLimit     int64
+	Delete             bool
+	MaxDelete          int
+	DryRun             bool
+	Retries            int
+	RetryBase          time.Duration
+	RetryMax           time.Duration
+	Requeue            int
+	Filters            []FilterRule
+	State              *State
+	Full               bool
+	Bidirectional      bool
+	Verify             bool
+	Compare            CompareMode
+	ConflictPolicy     ConflictPolicy
+	DeltaMinSize       int64
+	Checkpoint         string
+	CheckpointInterval time.Duration
+	Resume             bool
+	HttpClient         *http.Client
+	OnEvent            func(Event)
+}
+
+func DefaultOptions() Options {
+	return Options{
+		ListWorkers:        2,
+		TransferWorkers:    5,
+		MaxDelete:          100,
+		Compare:            CompareChecksum,
+		ConflictPolicy:     ConflictNewer,
+		DeltaMinSize:       1 << 20,
+		CheckpointInterval: time.Minute,
+		Retries:            5,
+		RetryBase:          500 * time.Millisecond,
+		RetryMax:           30 * time.Second,
+		Requeue:            2,
+	}
+}
+
+type EventKind string
+
+const (
+	EventMkdir      EventKind = "mkdir"
+	EventPut        EventKind = "put"
+	EventSkip       EventKind = "skip"
+	EventDelete     EventKind = "delete"
+	EventRetry      EventKind = "retry"
+	EventRequeue    EventKind = "requeue"
+	EventFailure    EventKind = "failure"
+	EventDivergence EventKind = "divergence"
+)
+
+// Event notifies an action performed, or planned in dry-run, on a path
+type Event struct {
+	Kind   EventKind
+	Path   string
+	Bytes  int64
+	Reason string
+	Err    error
+}
+
+type Syncer struct {
+	options           Options
+	source            *client.Client
+	target            *client.Client
+	bandwidth         *rate.Limiter
+	targetNeedsLength int32
+	deltaUnsupported  sync.Map
+	stateBucket       []byte
+	listed            sync.Map
+	listedTarget      sync.Map
+	requeueMu         sync.Mutex
+	requeued          map[string]int
+	extraneousMu      sync.Mutex
+	extraneous        map[string]int
+	planMu            sync.Mutex
+	dirsMu            sync.Mutex
+	checkpointMu      sync.RWMutex
+	dirs              map[string]*dirProgress
+	completedDirs     map[string]*dirProgress
+	dirTimes          map[string]time.Time
+	noSourceDirTimes  int32
+	plan              []PlanAction
+	statsMu           sync.Mutex
+	stats             Report
+	queueMu           sync.Mutex
+	queue             *workQueue
+	stopped           bool
+}
+
+func New(options Options) (*Syncer, error) {
+	if options.SourceUrl == "" || options.TargetUrl == "" {
+		return nil, fmt.Errorf("synchro: source and target URLs are required")
+	}
+	if options.ListWorkers < 1 || options.TransferWorkers < 1 {
+		return nil, fmt.Errorf("synchro: at least one listing and one transfer worker are required")
+	}
+	switch options.Compare {
+	case "", CompareChecksum, CompareSizeMtime, CompareSizeOnly, CompareAlways:
+	default:
+		return nil, fmt.Errorf("synchro: invalid compare mode %q", options.Compare)
+	}
+	if options.Resume && options.Checkpoint == "" {
+		return nil, fmt.Errorf("synchro: resuming requires a checkpoint file")
+	}
+	if options.Verify && (options.Bidirectional || options.Delete || options.DryRun) {
+		return nil, fmt.Errorf("synchro: the verification modifies nothing, it cannot be bidirectional, delete or dry-run")
+	}
+	if options.Bidirectional {
+		if options.State == nil {
+			return nil, fmt.Errorf("synchro: the bidirectional synchronization requires a state database")
+		}
+		if options.Delete {
+			return nil, fmt.Errorf("synchro: the bidirectional synchronization already propagates deletions")
+		}
+		switch options.ConflictPolicy {
+		case ConflictNewer, ConflictSource, ConflictKeepBoth:
+		default:
+			return nil, fmt.Errorf("synchro: invalid conflict policy %q", options.ConflictPolicy)
+		}
+	}
+	httpClient := options.HttpClient
+	if httpClient == nil {
+		httpClient = &http.Client{Transport: otelhttp.NewTransport(http.DefaultTransport)}
+	}
+	s := &Syncer{
+		options:       options,
+		source:        client.New(options.SourceUrl, httpClient),
+		target:        client.New(options.TargetUrl, httpClient),
+		stateBucket:   stateBucket(options.SourceUrl, options.TargetUrl, options.Bidirectional),
+		requeued:      make(map[string]int),
+		extraneous:    make(map[string]int),
+		dirs:          make(map[string]*dirProgress),
+		completedDirs: make(map[string]*dirProgress),
+		dirTimes:      make(map[string]time.Time),
+		plan:          []PlanAction{},
+	}
+	if options.BandwidthLimit > 0 {
+		s.bandwidth = rate.NewLimiter(rate.Limit(options.BandwidthLimit), int(options.BandwidthLimit))
+	}
+	return s, nil
+}
+
+func (s *Syncer) emit(event Event) {
+	if s.options.OnEvent != nil {
+		s.options.OnEvent(event)
+	}
+}
+
+// Stop makes the current and next runs return once the entries being processed are done,
+// without starting new ones
+func (s *Syncer) Stop() {
+	s.queueMu.Lock()
+	defer s.queueMu.Unlock()
+	s.stopped = true
+	if s.queue != nil {
+		s.queue.cancel()
+	}
+}
+
+func (s *Syncer) isStopped() bool {
+	s.queueMu.Lock()
+	defer s.queueMu.Unlock()
+	return s.stopped
+}
+
+// Run synchronizes the target with the source until all the work is done,
+// ctx is canceled or Stop is called, and returns the report of the run,
+// a Syncer running once at a time
+func (s *Syncer) Run(ctx context.Context) Report {
+	sourceUrl := s.options.SourceUrl
+	targetUrl := s.options.TargetUrl
+	ctx, span := tracing.Start(ctx, "runSynchro",
+		attribute.String("cabri.source", sourceUrl), attribute.String("cabri.target", targetUrl))
+	defer span.End()
+
+	logrus.Debugf("runSynchro %s %s", sourceUrl, targetUrl)
+	s.startReport()
+	for _, listed := range []*sync.Map{&s.listed, &s.listedTarget} {
+		listed.Range(func(key, _ interface{}) bool {
+			listed.Delete(key)
+			return true
+		})
+	}
+	s.requeueMu.Lock()
+	s.requeued = make(map[string]int)
+	s.requeueMu.Unlock()
+	s.extraneousMu.Lock()
+	s.extraneous = make(map[string]int)
+	s.extraneousMu.Unlock()
+	s.planMu.Lock()
+	s.plan = []PlanAction{}
+	s.planMu.Unlock()
+	s.dirsMu.Lock()
+	s.dirs = make(map[string]*dirProgress)
+	s.completedDirs = make(map[string]*dirProgress)
+	s.dirTimes = make(map[string]time.Time)
+	s.dirsMu.Unlock()
+
+	entries := []string{"/"}
+	if s.checkpointEnabled() && s.options.Resume {
+		cp, err := s.readCheckpoint()
+		switch {
+		case err != nil:
+			logrus.Errorf("runSynchro: resume: %v, starting from /", err)
+		case cp != nil:
+			var completed []string
+			entries, completed = s.restore(cp)
+			logrus.Infof("runSynchro: resuming %d entries checkpointed at %v", len(entries), cp.Time)
+			s.setDirTimes(ctx, completed)
+		}
+	}
+	queue := newWorkQueue()
+	queue.push("RSYN", entries...)
+	s.queueMu.Lock()
+	s.queue = queue
+	if s.stopped {
+		queue.cancel()
+	}
+	s.queueMu.Unlock()
+	stop := make(chan struct{})
+	stopped := make(chan struct{})
+	go func() {
+		defer close(stopped)
+		var tick <-chan time.Time
+		if s.checkpointEnabled() && s.options.CheckpointInterval > 0 {
+			ticker := time.NewTicker(s.options.CheckpointInterval)
+			defer ticker.Stop()
+			tick = ticker.C
+		}
+		for {
+			select {
+			case <-ctx.Done():
+				queue.cancel()
+				return
+			case <-tick:
+				s.saveCheckpoint(queue)
+			case <-stop:
+				return
+			}
+		}
+	}()
+	var wg sync.WaitGroup
+	for i := 0; i < s.options.ListWorkers+s.options.TransferWorkers; i++ {
+		ecId := fmt.Sprintf("EC#%d", i)
+		dirs := i < s.options.ListWorkers
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			s.entryConsumer(ctx, ecId, queue, dirs)
+		}()
+	}
+	wg.Wait()
+	close(stop)
+	<-stopped
+	s.queueMu.Lock()
+	s.queue = nil
+	s.queueMu.Unlock()
+	canceled := ctx.Err() != nil || s.isStopped()
+	if s.checkpointEnabled() && canceled {
+		s.saveCheckpoint(queue)
+	}
+	if s.options.Delete && !canceled {
+		if s.checkpointEnabled() {
+			s.saveCheckpoint(nil)
+		}
+		if err := s.deleteExtraneous(ctx); err != nil {
+			logrus.Errorf("runSynchro: delete: %v", err)
+		}
+	}
+	if s.checkpointEnabled() && !canceled {
+		if err := s.removeCheckpoint(); err != nil {
+			logrus.Errorf("runSynchro: checkpoint: %v", err)
+		}
+	}
+	logrus.Debugf("runSynchro %s %s exiting", sourceUrl, targetUrl)
+	return s.endReport(canceled)
+}
+
+func (s *Syncer) entryConsumer(ctx context.Context, id string, queue *workQueue, dirs bool) {
+	for {
+		path, ok := queue.pull(id, dirs)
+		if !ok {
+			return
+		}
+		logrus.Debugf("entryConsumer%s %s", id, path)
+		var err error
+		var entries []string
+		if isDir(path) {
+			if s.options.Verify {
+				entries, err = s.verifyDir(ctx, id, path)
+			} else if s.options.Bidirectional {
+				entries, err = s.bisyncDir(ctx, id, path)
+			} else {
+				entries, err = s.synchroDir(ctx, id, path)
+			}
+		} else if s.options.Verify {
+			err = s.verifyContent(ctx, id, path)
+		} else if s.options.Bidirectional {
+			err = s.bisyncContent(ctx, id, path)
+		} else {
+			err = s.synchroContent(ctx, id, path)
+		}
+		if err != nil && ctx.Err() != nil {
+			queue.interrupt(path)
+			continue
+		}
+		// a checkpoint sees the entry either pending or completed with the entries it produced
+		var completed []string
+		s.checkpointMu.RLock()
+		if err != nil && retryable(err) && s.requeue(path) {
+			logrus.WithField("path", path).WithError(err).Warn("entryConsumer: re-queued")
+			s.emit(Event{Kind: EventRequeue, Path: path, Err: err})
+			entries = append(entries, path)
+		} else {
+			completed = s.entryDone(path, err == nil && isDir(path))
+			if err != nil {
+				s.countStat(func(r *Report) {
+					if isDir(path) {
+						r.DirsFailed++
+					} else {
+						r.FilesFailed++
+					}
+				})
+				s.emit(Event{Kind: EventFailure, Path: path, Err: err})
+			}
+		}
+		queue.complete(id, path, entries...)
+		s.checkpointMu.RUnlock()
+		// out of the critical section as it requests the servers
+		s.setDirTimes(ctx, completed)
+	}
+}
+
+func isDir(path string) bool {
+	return path[len(path)-1] == '/'
+}
+
+func (s *Syncer) synchroDir(ctx context.Context, id string, path string) (entries []string, err error) {
+	var info *client.Info
+
+	ctx, span := tracing.Start(ctx, "synchroDir", attribute.String("cabri.path", path))
+	defer func() { tracing.End(span, err) }()
+
+	logrus.Debugf("synchroDir %s", path)
+
+	err = s.retry(ctx, "synchroDir: head", path, func() (err error) {
+		info, err = s.headEntry(ctx, s.target, path)
+		return
+	})
+	if err != nil {
+		logrus.WithField("path", path).WithError(err).Error("synchroDir: head")
+		return
+	}
+	exists := info != nil
+	if exists {
+		logrus.Debugf("synchroDir%s %s exists", id, path)
+	}
+
+	if !exists && s.options.DryRun {
+		s.addPlan("mkdir", path, "absent from target", 0)
+	} else if !exists {
+		err = s.retry(ctx, "synchroDir: put", path, func() error {
+			return s.target.Mkdir(ctx, path)
+		})
+		if err != nil {
+			logrus.WithField("path", path).WithError(err).Error("synchroDir: put")
+			return
+		}
+		logrus.WithField("path", path).Info("mkdir")
+		if path != "/" {
+			s.dirModified(parentDir(path))
+		}
+		s.countStat(func(r *Report) { r.DirsCreated++ })
+		s.emit(Event{Kind: EventMkdir, Path: path})
+	}
+
+	err = s.retry(ctx, "synchroDir: get", path, func() (err error) {
+		entries, err = s.listSource(ctx, id, path)
+		return
+	})
+	if err != nil {
+		logrus.WithField("path", path).WithError(err).Error("synchroDir: get")
+		return nil, err
+	}
+	s.countStat(func(r *Report) { r.DirsListed++ })
+	if exists && s.metadataCompare() {
+		s.listTarget(ctx, id, path)
+	} else if s.metadataCompare() {
+		s.listedTarget.Store(path, &client.Info{Path: path, IsDir: true})
+	}
+	entries = s.filterEntries(entries)
+	if s.options.Delete && exists {
+		// the mirror is incomplete but the entries of the directory are still synchronized
+		if fErr := s.findExtraneous(ctx, id, path, entries); fErr != nil {
+			logrus.WithField("path", path).WithError(fErr).Error("synchroDir: find extraneous")
+			s.countStat(func(r *Report) { r.DirsFailed++ })
+			s.emit(Event{Kind: EventFailure, Path: path, Err: fErr})
+		}
+	}
+	var targetTime time.Time
+	if exists {
+		targetTime = info.LastModified
+	}
+	s.expectEntries(path, len(entries), targetTime)
+	return
+}
+
+// headEntry returns nil when the entry does not exist
+func (s *Syncer) headEntry(ctx context.Context, c *client.Client, path string) (info *client.Info, err error) {
+	info, err = c.Stat(ctx, path)
+	if errors.Is(err, client.ErrNotFound) {
+		return nil, nil
+	}
+	return
+}
+
+func (s *Syncer) listDir(ctx context.Context, id string, c *client.Client, path string) (entries []string, err error) {
+	entries, err = c.List(ctx, path)
+	logrus.Debugf("listDir%s %s%s %d entries err %v", id, c.BaseUrl(), path, len(entries), err)
+	return
+}
+
+// listSource lists the source directory, keeping the size and modification time
+// of its entries when a state database allows to skip the unchanged ones
+// or when the files are compared with them, and the modification time of its subdirectories
+func (s *Syncer) listSource(ctx context.Context, id string, path string) (entries []string, err error) {
+	if (s.options.State == nil || s.options.Full) && !s.metadataCompare() {
+		return s.listDir(ctx, id, s.source, path)
+	}
+	var infos []*client.Info
+	infos, err = s.source.ListInfo(ctx, path)
+	logrus.Debugf("listSource%s %s %d entries err %v", id, path, len(infos), err)
+	if err != nil {
+		return
+	}
+	for _, info := range infos {
+		entries = append(entries, info.Path)
+		s.listed.Store(info.Path, info)
+	}
+	return
+}
+
+func (s *Syncer) listedInfo(path string) *client.Info {
+	if info, ok := s.listed.Load(path); ok {
+		return info.(*client.Info)
+	}
+	return nil
+}
+
+func (s *Syncer) synchroContent(ctx context.Context, id string, path string) (err error) {
+	var info *client.Info
+
+	ctx, span := tracing.Start(ctx, "synchroContent", attribute.String("cabri.path", path))
+	defer func() { tracing.End(span, err) }()
+
+	logrus.Debugf("synchroContent%s %s", id, path)
+
+	if listed := s.listedInfo(path); s.options.Compare != CompareAlways && s.unchanged(path, listed) {
+		logrus.Debugf("synchroContent%s %s unchanged since last run", id, path)
+		s.countStat(func(r *Report) { r.FilesSkipped++ })
+		if s.options.DryRun {
+			s.addPlan("skip", path, "unchanged since last run", listed.Size)
+		} else {
+			s.emit(Event{Kind: EventSkip, Path: path, Bytes: listed.Size, Reason: "unchanged since last run"})
+		}
+		return
+	}
+
+	var cmp comparison
+	if cmp, err = s.compareContent(ctx, id, path); err != nil {
+		return
+	}
+	if cmp.same {
+		s.countStat(func(r *Report) { r.FilesSkipped++ })
+		s.recordState(path, cmp.source)
+		if s.options.DryRun {
+			s.addPlan("skip", path, cmp.reason, cmp.sourceSize)
+		} else {
+			s.emit(Event{Kind: EventSkip, Path: path, Bytes: cmp.sourceSize, Reason: cmp.reason})
+		}
+		return
+	}
+
+	if s.options.DryRun {
+		s.addPlan("put", path, cmp.reason, cmp.sourceSize)
+		return
+	}
+
+	var size, sent int64
+	err = s.retry(ctx, "synchroContent: copy", path, func() (err error) {
+		info, sent, err = s.copyContent(ctx, id, s.source, s.target, path, path, cmp.targetSize)
+		return
+	})
+	if err != nil {
+		logrus.WithField("path", path).WithError(err).Error("synchroContent: copy")
+		return
+	}
+	logrus.WithField("path", path).Info("put content")
+	s.dirModified(parentDir(path))
+	size = info.Size
+	s.recordState(path, info)
+	s.countStat(func(r *Report) {
+		r.FilesCopied++
+		r.BytesTransferred += sent
+	})
+	s.emit(Event{Kind: EventPut, Path: path, Bytes: size})
+	return
+}
+
+// copyContent streams the source content to the target, the content being spooled
+// to a temporary file only when its length is unknown and the target requires it,
+// and returns the source information with the size and checksum of the content copied, and the bytes sent.
+// When the target content of baseSize bytes is large enough, only the differences are sent if possible
+func (s *Syncer) copyContent(ctx context.Context, id string, from *client.Client, to *client.Client, fromPath string, toPath string, baseSize int64) (info *client.Info, sent int64, err error) {
+	if s.options.DeltaMinSize > 0 && baseSize >= s.options.DeltaMinSize && s.deltaSupported(to) {
+		if info, sent, err = s.deltaContent(ctx, id, from, to, fromPath, toPath, baseSize); !errors.Is(err, errNoDelta) {
+			return
+		}
+		logrus.Debugf("copyContent%s %s %v, copying the whole content", id, fromPath, err)
+	}
+	var content io.ReadCloser
+	if content, info, err = from.Get(ctx, fromPath); err != nil {
+		return
+	}
+	defer content.Close()
+
+	h := sha256.New()
+	counter := &countingReader{r: io.TeeReader(s.throttle(ctx, content), h)}
+	var body io.Reader = counter
+	length := info.Size
+	if length < 0 && atomic.LoadInt32(&s.targetNeedsLength) != 0 {
+		var spool *os.File
+		if spool, length, err = spoolContent(body); err != nil {
+			return
+		}
+		defer os.Remove(spool.Name())
+		defer spool.Close()
+		body = spool
+	}
+
+	logrus.Debugf("copyContent%s %s put %s%s %d bytes", id, fromPath, to.BaseUrl(), toPath, length)
+	var targetCs string
+	targetCs, err = to.Put(ctx, toPath, body, length, info.LastModified)
+	var se *client.StatusError
+	if errors.As(err, &se) && se.Status == http.StatusLengthRequired && length < 0 {
+		logrus.Debugf("copyContent%s %s target requires a known length, spooling from now on", id, fromPath)
+		atomic.StoreInt32(&s.targetNeedsLength, 1)
+	}
+	if err != nil {
+		return
+	}
+	info.Size = counter.n
+	sent = counter.n
+	info.Checksum = fmt.Sprintf("%x", h.Sum(nil))
+	if targetCs != "" && targetCs != info.Checksum {
+		err = fmt.Errorf("checksum mismatch, sent %s, target %s", info.Checksum, targetCs)
+	}
+	return
+}
+
+type countingReader struct {
+	r io.Reader
+	n int64
+}
+
+func (cr *countingReader) Read(p []byte) (n int, err error) {
+	n, err = cr.r.Read(p)
+	cr.n += int64(n)
+	return
+}
+
+func spoolContent(body io.Reader) (spool *os.File, size int64, err error) {
+	if spool, err = ioutil.TempFile("", "cabri*"); err != nil {
+		return
+	}
+	if size, err = io.Copy(spool, body); err == nil {
+		_, err = spool.Seek(0, io.SeekStart)
+	}
+	if err != nil {
+		spool.Close()
+		os.Remove(spool.Name())
+		spool = nil
+	}
+	return
+}
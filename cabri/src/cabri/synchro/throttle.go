@@ -0,0 +1,59 @@
+package synchro
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+
+	"golang.org/x/time/rate"
+)
+
+// ParseBytes accepts a number of bytes with an optional K, M or G binary suffix
+func ParseBytes(s string) (int64, error) {
+	multiplier := int64(1)
+	switch {
+	case strings.HasSuffix(s, "K"):
+		multiplier = 1 << 10
+	case strings.HasSuffix(s, "M"):
+		multiplier = 1 << 20
+	case strings.HasSuffix(s, "G"):
+		multiplier = 1 << 30
+	}
+	if multiplier != 1 {
+		s = s[:len(s)-1]
+	}
+	n, err := strconv.ParseInt(s, 10, 64)
+	if err != nil || n < 0 {
+		return 0, fmt.Errorf("invalid byte count %q", s)
+	}
+	return n * multiplier, nil
+}
+
+type throttledReader struct {
+	ctx       context.Context
+	r         io.Reader
+	bandwidth *rate.Limiter
+}
+
+// throttle shares the bandwidth limit between all the transfers of the syncer
+func (s *Syncer) throttle(ctx context.Context, r io.Reader) io.Reader {
+	if s.bandwidth == nil {
+		return r
+	}
+	return &throttledReader{ctx: ctx, r: r, bandwidth: s.bandwidth}
+}
+
+func (tr *throttledReader) Read(p []byte) (n int, err error) {
+	if len(p) > tr.bandwidth.Burst() {
+		p = p[:tr.bandwidth.Burst()]
+	}
+	n, err = tr.r.Read(p)
+	if n > 0 {
+		if werr := tr.bandwidth.WaitN(tr.ctx, n); werr != nil && err == nil {
+			err = werr
+		}
+	}
+	return
+}
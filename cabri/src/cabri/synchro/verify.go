@@ -0,0 +1,179 @@
+package synchro
+
+import (
+	"cabri/client"
+	"cabri/tracing"
+	"context"
+	"strings"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"go.opentelemetry.io/otel/attribute"
+)
+
+const (
+	VerifyMissing   = "missing"
+	VerifyExtra     = "extra"
+	VerifyDivergent = "divergent"
+)
+
+type VerifiedEntry struct {
+	Size         int64     `json:"size"`
+	LastModified time.Time `json:"last_modified"`
+	Checksum     string    `json:"checksum,omitempty"`
+}
+
+// Divergence is an entry missing from the target, extra on the target or differing
+// by the listed differences: size, mtime or checksum
+type Divergence struct {
+	Path        string         `json:"path"`
+	Status      string         `json:"status"`
+	Differences []string       `json:"differences,omitempty"`
+	Source      *VerifiedEntry `json:"source,omitempty"`
+	Target      *VerifiedEntry `json:"target,omitempty"`
+}
+
+func verifiedEntry(info *client.Info) *VerifiedEntry {
+	if info == nil || info.IsDir {
+		return nil
+	}
+	return &VerifiedEntry{Size: info.Size, LastModified: info.LastModified, Checksum: info.Checksum}
+}
+
+func (s *Syncer) diverge(d Divergence) {
+	logrus.WithFields(logrus.Fields{"path": d.Path, "differences": strings.Join(d.Differences, ", ")}).Infof("verify: %s", d.Status)
+	s.countStat(func(r *Report) {
+		switch d.Status {
+		case VerifyMissing:
+			r.Missing++
+		case VerifyExtra:
+			r.Extra++
+		default:
+			r.Divergent++
+		}
+		r.Divergences = append(r.Divergences, d)
+	})
+	s.emit(Event{Kind: EventDivergence, Path: d.Path, Reason: d.Status + " " + strings.Join(d.Differences, ", ")})
+}
+
+// verifyDir lists a directory on both sides, reports the entries present on one side only,
+// without descending into such directories, and returns the entries present on both sides
+func (s *Syncer) verifyDir(ctx context.Context, id string, path string) (entries []string, err error) {
+	ctx, span := tracing.Start(ctx, "verifyDir", attribute.String("cabri.path", path))
+	defer func() { tracing.End(span, err) }()
+
+	logrus.Debugf("verifyDir%s %s", id, path)
+	source, target := s.sides()
+	var srcInfos, tgtInfos map[string]*client.Info
+	if srcInfos, _, err = s.listSide(ctx, source, path); err != nil {
+		logrus.WithField("path", path).WithError(err).Error("verifyDir: list source")
+		return nil, err
+	}
+	if tgtInfos, _, err = s.listSide(ctx, target, path); err != nil {
+		logrus.WithField("path", path).WithError(err).Error("verifyDir: list target")
+		return nil, err
+	}
+	s.countStat(func(r *Report) { r.DirsListed++ })
+
+	var names []string
+	for name := range srcInfos {
+		names = append(names, name)
+	}
+	for name := range tgtInfos {
+		if _, ok := srcInfos[name]; !ok {
+			names = append(names, name)
+		}
+	}
+	for _, name := range s.filterEntries(names) {
+		src, tgt := srcInfos[name], tgtInfos[name]
+		switch {
+		case tgt == nil:
+			s.diverge(Divergence{Path: name, Status: VerifyMissing, Source: verifiedEntry(src)})
+		case src == nil:
+			s.diverge(Divergence{Path: name, Status: VerifyExtra, Target: verifiedEntry(tgt)})
+		default:
+			entries = append(entries, name)
+		}
+	}
+	return
+}
+
+// verifyContent compares the size and modification time listed on both sides
+// and, when the sizes are the same, the checksums
+func (s *Syncer) verifyContent(ctx context.Context, id string, path string) (err error) {
+	ctx, span := tracing.Start(ctx, "verifyContent", attribute.String("cabri.path", path))
+	defer func() { tracing.End(span, err) }()
+
+	source, target := s.sides()
+	var src, tgt *client.Info
+	if src, err = s.sideInfo(ctx, source, path); err != nil {
+		logrus.WithField("path", path).WithError(err).Error("verifyContent: list source")
+		return
+	}
+	if tgt, err = s.sideInfo(ctx, target, path); err != nil {
+		logrus.WithField("path", path).WithError(err).Error("verifyContent: list target")
+		return
+	}
+	switch {
+	case src == nil && tgt == nil:
+		return
+	case tgt == nil:
+		s.diverge(Divergence{Path: path, Status: VerifyMissing, Source: verifiedEntry(src)})
+		return
+	case src == nil:
+		s.diverge(Divergence{Path: path, Status: VerifyExtra, Target: verifiedEntry(tgt)})
+		return
+	}
+	var differences []string
+	sizeDiffers := src.Size >= 0 && tgt.Size >= 0 && src.Size != tgt.Size
+	if sizeDiffers {
+		differences = append(differences, "size")
+	}
+	if !src.LastModified.IsZero() && !tgt.LastModified.IsZero() &&
+		!src.LastModified.Truncate(time.Second).Equal(tgt.LastModified.Truncate(time.Second)) {
+		differences = append(differences, "mtime")
+	}
+	if !sizeDiffers {
+		for _, sd := range []side{source, target} {
+			var info *client.Info
+			err = s.retry(ctx, "verifyContent: head "+sd.name, path, func() (err error) {
+				info, err = s.headEntry(ctx, sd.c, path)
+				return
+			})
+			if err != nil {
+				logrus.WithFields(logrus.Fields{"path": path, "side": sd.name}).WithError(err).Error("verifyContent: head")
+				return
+			}
+			if info == nil {
+				continue
+			}
+			if sd.target {
+				tgt.Checksum = info.Checksum
+			} else {
+				src.Checksum = info.Checksum
+			}
+		}
+		if src.Checksum != tgt.Checksum {
+			differences = append(differences, "checksum")
+		}
+	}
+	logrus.Debugf("verifyContent%s %s differences %v", id, path, differences)
+	if len(differences) == 0 {
+		s.countStat(func(r *Report) { r.Verified++ })
+		return
+	}
+	s.diverge(Divergence{Path: path, Status: VerifyDivergent, Differences: differences, Source: verifiedEntry(src), Target: verifiedEntry(tgt)})
+	return
+}
+
+// sideInfo returns the information of a file listed on a side, nil if absent,
+// listing its directory again when unknown, as after resuming from a checkpoint without it
+func (s *Syncer) sideInfo(ctx context.Context, sd side, path string) (info *client.Info, err error) {
+	if info = sd.info(path); info != nil {
+		return
+	}
+	if _, _, err = s.listSide(ctx, sd, parentDir(path)); err != nil {
+		return
+	}
+	return sd.info(path), nil
+}
@@ -0,0 +1,138 @@
+package synchro
+
+import (
+	"cabri/client"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+)
+
+// newFakeServer serves the listings and the HEAD requests of a read-only cabri server
+// mounted on /fs, files mapping the paths to their content
+func newFakeServer(t *testing.T, files map[string]string, modTime time.Time) string {
+	t.Helper()
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		path := strings.TrimPrefix(r.URL.Path, "/fs")
+		if !strings.HasSuffix(path, "/") {
+			content, ok := files[path]
+			if !ok || r.Method != http.MethodHead {
+				http.NotFound(w, r)
+				return
+			}
+			sum := sha256.Sum256([]byte(content))
+			w.Header().Set("Checksum", hex.EncodeToString(sum[:]))
+			w.Header().Set("Content-Length", fmt.Sprintf("%d", len(content)))
+			w.Header().Set("Last-Modified", modTime.UTC().Format(client.TimeFormat))
+			return
+		}
+		entries := make(map[string]int64)
+		for p, content := range files {
+			if !strings.HasPrefix(p, path) {
+				continue
+			}
+			if i := strings.Index(p[len(path):], "/"); i >= 0 {
+				entries[p[:len(path)+i+1]] = -1
+			} else {
+				entries[p] = int64(len(content))
+			}
+		}
+		if len(entries) == 0 && path != "/" {
+			http.NotFound(w, r)
+			return
+		}
+		if r.Method == http.MethodHead {
+			return
+		}
+		names := make([]string, 0, len(entries))
+		for name := range entries {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			fmt.Fprintf(w, "%s\t%d\t%s\n", name, entries[name], modTime.UTC().Format(client.TimeFormat))
+		}
+		fmt.Fprintf(w, "\n")
+	}))
+	t.Cleanup(server.Close)
+	return server.URL + "/fs"
+}
+
+func newVerifySyncer(t *testing.T, checkpoint string) *Syncer {
+	t.Helper()
+	modTime := time.Date(2026, 10, 19, 12, 0, 0, 0, time.UTC)
+	s, err := New(Options{
+		SourceUrl: newFakeServer(t, map[string]string{
+			"/d/same": "content", "/d/size": "content", "/d/checksum": "content", "/d/missing": "content",
+		}, modTime),
+		TargetUrl: newFakeServer(t, map[string]string{
+			"/d/same": "content", "/d/size": "longer content", "/d/checksum": "CONTENT", "/d/extra": "content",
+		}, modTime),
+		ListWorkers:     1,
+		TransferWorkers: 1,
+		Retries:         1,
+		Verify:          true,
+		Checkpoint:      checkpoint,
+		Resume:          checkpoint != "",
+	})
+	if err != nil {
+		t.Fatalf("New: %v", err)
+	}
+	return s
+}
+
+func checkVerifyReport(t *testing.T, report Report, verified int64, missing int64, extra int64, divergent int64) {
+	t.Helper()
+	if report.Verified != verified || report.Missing != missing || report.Extra != extra || report.Divergent != divergent {
+		t.Errorf("verified %d missing %d extra %d divergent %d, expected %d %d %d %d",
+			report.Verified, report.Missing, report.Extra, report.Divergent, verified, missing, extra, divergent)
+	}
+	if report.FilesFailed != 0 {
+		t.Errorf("%d files failed", report.FilesFailed)
+	}
+}
+
+func TestVerify(t *testing.T) {
+	s := newVerifySyncer(t, "")
+	checkVerifyReport(t, s.Run(context.Background()), 1, 1, 1, 2)
+}
+
+// TestVerifyResumeWithoutListed starts again from the root instead of resuming from a checkpoint
+// written before the listed information was kept
+func TestVerifyResumeWithoutListed(t *testing.T) {
+	fileName := filepath.Join(t.TempDir(), "checkpoint")
+	s := newVerifySyncer(t, fileName)
+	content, err := json.Marshal(map[string]interface{}{
+		"source":  s.options.SourceUrl,
+		"target":  s.options.TargetUrl,
+		"time":    time.Now(),
+		"pending": []string{"/d/checksum", "/d/missing", "/d/same", "/d/size"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = ioutil.WriteFile(fileName, content, 0644); err != nil {
+		t.Fatal(err)
+	}
+	checkVerifyReport(t, s.Run(context.Background()), 1, 1, 1, 2)
+}
+
+func TestVerifyContentUnlisted(t *testing.T) {
+	s := newVerifySyncer(t, "")
+	s.startReport()
+	for _, path := range []string{"/d/same", "/d/size", "/d/missing", "/d/extra", "/d/gone"} {
+		if err := s.verifyContent(context.Background(), "T", path); err != nil {
+			t.Errorf("verifyContent %s: %v", path, err)
+		}
+	}
+	checkVerifyReport(t, s.endReport(false), 1, 1, 1, 1)
+}
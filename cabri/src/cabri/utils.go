@@ -1,12 +1,24 @@
 package cabri
 
 import (
+	"cabri/tracing"
+	"context"
 	"crypto/sha256"
 	"fmt"
 	"io"
+	"math/rand"
 	"net/http"
 	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
 	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/sirupsen/logrus"
+	"go.opentelemetry.io/otel/attribute"
 )
 
 const TimeFormat = "Mon, 02 Jan 2006 15:04:05 GMT"
@@ -23,7 +35,36 @@ func SetLastModified(w http.ResponseWriter, modtime time.Time) {
 	}
 }
 
-func GetChecksum(checksum string, path string) (cs string, err error) {
+// listMeta tells whether the listing lines must include the size and modification time of the entries
+func listMeta(c *gin.Context) bool {
+	_, ok := c.Request.URL.Query()["meta"]
+	return ok
+}
+
+// writeListEntry writes a listing line, with the size and the modification time
+// separated by tabs when meta is set, "-" standing for an unknown value
+func writeListEntry(w io.Writer, path string, meta bool, size int64, modtime time.Time) {
+	if !meta {
+		fmt.Fprintf(w, "%s\n", path)
+		return
+	}
+	sz, mt := "-", "-"
+	if size >= 0 {
+		sz = strconv.FormatInt(size, 10)
+	}
+	if !isZeroTime(modtime) {
+		mt = modtime.UTC().Format(TimeFormat)
+	}
+	fmt.Fprintf(w, "%s\t%s\t%s\n", path, sz, mt)
+}
+
+func GetChecksum(ctx context.Context, checksum string, path string) (cs string, err error) {
+	_, span := tracing.Start(ctx, "GetChecksum", attribute.String("cabri.path", path))
+	defer func() { tracing.End(span, err) }()
+	if err = acquireChecksum(ctx); err != nil {
+		return
+	}
+	defer releaseChecksum()
 	f, err := os.Open(path)
 	if err != nil {
 		return
@@ -38,3 +79,59 @@ func GetChecksum(checksum string, path string) (cs string, err error) {
 	cs = fmt.Sprintf("%x", h.Sum(nil))
 	return
 }
+
+const tempFilePrefix = ".cabri-"
+
+// tempFileName matches the names of the temporary files created in the served directories
+var tempFileName = regexp.MustCompile(`^\.cabri-[a-z]+-[0-9]+\.tmp$`)
+
+func isTempFile(name string) bool {
+	return tempFileName.MatchString(name)
+}
+
+var tempFiles = make(map[string]bool)
+var tempFilesMu sync.Mutex
+
+// createTempFile creates a file like ioutil.TempFile but with the permissions perm, before the umask
+func createTempFile(dir string, pattern string, perm os.FileMode) (f *os.File, err error) {
+	if dir == "" {
+		dir = os.TempDir()
+	}
+	prefix, suffix := pattern, ""
+	if i := strings.LastIndex(pattern, "*"); i >= 0 {
+		prefix, suffix = pattern[:i], pattern[i+1:]
+	}
+	for try := 0; try < 10000; try++ {
+		name := filepath.Join(dir, prefix+strconv.FormatUint(uint64(rand.Uint32()), 10)+suffix)
+		if f, err = os.OpenFile(name, os.O_RDWR|os.O_CREATE|os.O_EXCL, perm); !os.IsExist(err) {
+			break
+		}
+	}
+	if err != nil {
+		return
+	}
+	tempFilesMu.Lock()
+	defer tempFilesMu.Unlock()
+	tempFiles[f.Name()] = true
+	return
+}
+
+func removeTempFile(f *os.File) {
+	f.Close()
+	os.Remove(f.Name())
+	tempFilesMu.Lock()
+	defer tempFilesMu.Unlock()
+	delete(tempFiles, f.Name())
+}
+
+func cleanTempFiles() {
+	tempFilesMu.Lock()
+	defer tempFilesMu.Unlock()
+	for name := range tempFiles {
+		logrus.Debugf("cleanTempFiles %s", name)
+		if err := os.Remove(name); err != nil && !os.IsNotExist(err) {
+			logrus.Errorf("cleanTempFiles %s: %v\n", name, err)
+		}
+		delete(tempFiles, name)
+	}
+}
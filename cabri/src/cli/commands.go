@@ -0,0 +1,458 @@
+package main
+
+import (
+	"cabri/client"
+	"context"
+	"crypto/sha256"
+	"flag"
+	"fmt"
+	"hash"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+func newFlagSet(name string) *flag.FlagSet {
+	fs := flag.NewFlagSet(name, flag.ExitOnError)
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage of cabri %s:\n", commands[name].usage)
+		fs.PrintDefaults()
+	}
+	return fs
+}
+
+func isDir(path string) bool {
+	return strings.HasSuffix(path, "/")
+}
+
+func dirPath(path string) string {
+	if isDir(path) {
+		return path
+	}
+	return path + "/"
+}
+
+func checksum(h hash.Hash) string {
+	return fmt.Sprintf("%x", h.Sum(nil))
+}
+
+func verifyChecksum(path string, expected string, actual string) error {
+	if expected != "" && actual != "" && expected != actual {
+		return fmt.Errorf("%s: checksum mismatch, expected %s, got %s", path, expected, actual)
+	}
+	return nil
+}
+
+func formatTime(t time.Time) string {
+	if t.IsZero() {
+		return "-"
+	}
+	return t.UTC().Format(client.TimeFormat)
+}
+
+// walk calls fn for the entries under dir, depth first, each directory before its content,
+// listing the directories with the size and modification time of their entries
+func walk(ctx context.Context, c *client.Client, dir string, depth int, fn func(info *client.Info, depth int) error) error {
+	infos, err := c.ListInfo(ctx, dir)
+	if err != nil {
+		return err
+	}
+	for _, info := range infos {
+		if err = fn(info, depth); err != nil {
+			return err
+		}
+		if info.IsDir {
+			if err = walk(ctx, c, info.Path, depth+1, fn); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// completeInfo gets the information of a file whose listing did not tell the size or the modification time
+func completeInfo(ctx context.Context, c *client.Client, info *client.Info) (*client.Info, error) {
+	if info.IsDir || info.Size >= 0 && !info.LastModified.IsZero() {
+		return info, nil
+	}
+	return c.Stat(ctx, info.Path)
+}
+
+func ls(ctx context.Context, c *client.Client, args []string) error {
+	fs := newFlagSet("ls")
+	long := fs.Bool("l", false, "Displays the size and the modification time of the entries")
+	fs.Parse(args)
+	paths := fs.Args()
+	if len(paths) == 0 {
+		paths = []string{"/"}
+	}
+	for _, p := range paths {
+		var infos []*client.Info
+		var err error
+		if isDir(p) {
+			if infos, err = c.ListInfo(ctx, p); err != nil {
+				return err
+			}
+		} else {
+			var info *client.Info
+			if info, err = c.Stat(ctx, p); err != nil {
+				return err
+			}
+			infos = []*client.Info{info}
+		}
+		for _, info := range infos {
+			if !*long {
+				fmt.Println(info.Path)
+				continue
+			}
+			if info, err = completeInfo(ctx, c, info); err != nil {
+				return err
+			}
+			size := "-"
+			if !info.IsDir {
+				size = fmt.Sprintf("%d", info.Size)
+			}
+			fmt.Printf("%12s %-29s %s\n", size, formatTime(info.LastModified), info.Path)
+		}
+	}
+	return nil
+}
+
+func stat(ctx context.Context, c *client.Client, args []string) error {
+	fs := newFlagSet("stat")
+	fs.Parse(args)
+	for _, p := range fs.Args() {
+		info, err := c.Stat(ctx, p)
+		if err != nil {
+			return err
+		}
+		fmt.Printf("path: %s\n", info.Path)
+		if info.IsDir {
+			fmt.Printf("type: directory\n")
+		} else {
+			fmt.Printf("type: file\n")
+			fmt.Printf("size: %d\n", info.Size)
+			fmt.Printf("checksum: %s\n", info.Checksum)
+		}
+		fmt.Printf("last-modified: %s\n", formatTime(info.LastModified))
+	}
+	return nil
+}
+
+func get(ctx context.Context, c *client.Client, args []string) error {
+	fs := newFlagSet("get")
+	recursive := fs.Bool("r", false, "Gets directories with their content")
+	fs.Parse(args)
+	if fs.NArg() != 2 {
+		fs.Usage()
+		os.Exit(1)
+	}
+	remote, local := fs.Arg(0), fs.Arg(1)
+	if isDir(remote) {
+		if !*recursive {
+			return fmt.Errorf("%s is a directory, use -r", remote)
+		}
+		return getDir(ctx, c, remote, local)
+	}
+	if fi, err := os.Stat(local); err == nil && fi.IsDir() {
+		local = filepath.Join(local, path.Base(remote))
+	}
+	return getFile(ctx, c, remote, local)
+}
+
+func getDir(ctx context.Context, c *client.Client, remote string, local string) error {
+	if err := os.MkdirAll(local, 0755); err != nil {
+		return err
+	}
+	entries, err := c.List(ctx, remote)
+	if err != nil {
+		return err
+	}
+	for _, entry := range entries {
+		name := filepath.Join(local, strings.TrimSuffix(strings.TrimPrefix(entry, remote), "/"))
+		if isDir(entry) {
+			err = getDir(ctx, c, entry, name)
+		} else {
+			err = getFile(ctx, c, entry, name)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// getFile writes the content to a temporary file renamed once its checksum is verified
+func getFile(ctx context.Context, c *client.Client, remote string, local string) (err error) {
+	var info *client.Info
+	if info, err = c.Stat(ctx, remote); err != nil {
+		return
+	}
+	var content io.ReadCloser
+	if content, _, err = c.Get(ctx, remote); err != nil {
+		return
+	}
+	defer content.Close()
+	var f *os.File
+	if f, err = ioutil.TempFile(filepath.Dir(local), ".cabri-get*"); err != nil {
+		return
+	}
+	defer func() {
+		if err != nil {
+			f.Close()
+			os.Remove(f.Name())
+		}
+	}()
+	h := sha256.New()
+	var size int64
+	if size, err = io.Copy(io.MultiWriter(f, h), content); err != nil {
+		return
+	}
+	if err = verifyChecksum(remote, info.Checksum, checksum(h)); err != nil {
+		return
+	}
+	if err = f.Chmod(0644); err != nil {
+		return
+	}
+	if err = f.Close(); err != nil {
+		return
+	}
+	if !info.LastModified.IsZero() {
+		if err = os.Chtimes(f.Name(), info.LastModified, info.LastModified); err != nil {
+			return
+		}
+	}
+	if err = os.Rename(f.Name(), local); err != nil {
+		return
+	}
+	logrus.Debugf("get %s %s %d bytes", remote, local, size)
+	return
+}
+
+func put(ctx context.Context, c *client.Client, args []string) error {
+	fs := newFlagSet("put")
+	recursive := fs.Bool("r", false, "Puts directories with their content")
+	fs.Parse(args)
+	if fs.NArg() != 2 {
+		fs.Usage()
+		os.Exit(1)
+	}
+	local, remote := fs.Arg(0), fs.Arg(1)
+	fi, err := os.Stat(local)
+	if err != nil {
+		return err
+	}
+	if fi.IsDir() {
+		if !*recursive {
+			return fmt.Errorf("%s is a directory, use -r", local)
+		}
+		return putDir(ctx, c, local, dirPath(remote))
+	}
+	if isDir(remote) {
+		remote += filepath.Base(local)
+	}
+	return putFile(ctx, c, local, remote)
+}
+
+func putDir(ctx context.Context, c *client.Client, local string, remote string) error {
+	if err := c.Mkdir(ctx, remote); err != nil {
+		return err
+	}
+	fis, err := ioutil.ReadDir(local)
+	if err != nil {
+		return err
+	}
+	for _, fi := range fis {
+		name := filepath.Join(local, fi.Name())
+		if fi.IsDir() {
+			err = putDir(ctx, c, name, remote+fi.Name()+"/")
+		} else if fi.Mode().IsRegular() {
+			err = putFile(ctx, c, name, remote+fi.Name())
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func putFile(ctx context.Context, c *client.Client, local string, remote string) error {
+	f, err := os.Open(local)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	fi, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	h := sha256.New()
+	cs, err := c.Put(ctx, remote, io.TeeReader(f, h), fi.Size(), fi.ModTime())
+	if err != nil {
+		return err
+	}
+	logrus.Debugf("put %s %s %d bytes", local, remote, fi.Size())
+	return verifyChecksum(remote, checksum(h), cs)
+}
+
+func mkdir(ctx context.Context, c *client.Client, args []string) error {
+	fs := newFlagSet("mkdir")
+	fs.Parse(args)
+	for _, p := range fs.Args() {
+		if err := c.Mkdir(ctx, dirPath(p)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func rm(ctx context.Context, c *client.Client, args []string) error {
+	fs := newFlagSet("rm")
+	recursive := fs.Bool("r", false, "Removes directories with their content")
+	fs.Parse(args)
+	for _, p := range fs.Args() {
+		if err := c.Delete(ctx, p, *recursive); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func cp(ctx context.Context, c *client.Client, args []string) error {
+	fs := newFlagSet("cp")
+	recursive := fs.Bool("r", false, "Copies directories with their content")
+	targetUrl := fs.String("target-url", "", "Base URL of the target path, defaults to the url flag")
+	fs.Parse(args)
+	if fs.NArg() != 2 {
+		fs.Usage()
+		os.Exit(1)
+	}
+	target := c
+	if *targetUrl != "" {
+		target = client.New(*targetUrl, nil)
+	}
+	source, dest := fs.Arg(0), fs.Arg(1)
+	if isDir(source) {
+		if !*recursive {
+			return fmt.Errorf("%s is a directory, use -r", source)
+		}
+		return cpDir(ctx, c, target, source, dirPath(dest))
+	}
+	if isDir(dest) {
+		dest += path.Base(source)
+	}
+	return cpFile(ctx, c, target, source, dest)
+}
+
+func cpDir(ctx context.Context, c *client.Client, target *client.Client, source string, dest string) error {
+	if err := target.Mkdir(ctx, dest); err != nil {
+		return err
+	}
+	entries, err := c.List(ctx, source)
+	if err != nil {
+		return err
+	}
+	for _, entry := range entries {
+		name := dest + strings.TrimPrefix(entry, source)
+		if isDir(entry) {
+			err = cpDir(ctx, c, target, entry, name)
+		} else {
+			err = cpFile(ctx, c, target, entry, name)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// cpFile streams the content from the source to the target,
+// verifying the checksum of the data sent against both sides
+func cpFile(ctx context.Context, c *client.Client, target *client.Client, source string, dest string) error {
+	info, err := c.Stat(ctx, source)
+	if err != nil {
+		return err
+	}
+	content, _, err := c.Get(ctx, source)
+	if err != nil {
+		return err
+	}
+	defer content.Close()
+	h := sha256.New()
+	cs, err := target.Put(ctx, dest, io.TeeReader(content, h), info.Size, info.LastModified)
+	if err != nil {
+		return err
+	}
+	logrus.Debugf("cp %s %s %d bytes", source, dest, info.Size)
+	if err = verifyChecksum(source, info.Checksum, checksum(h)); err != nil {
+		return err
+	}
+	return verifyChecksum(dest, checksum(h), cs)
+}
+
+func du(ctx context.Context, c *client.Client, args []string) error {
+	fs := newFlagSet("du")
+	fs.Parse(args)
+	paths := fs.Args()
+	if len(paths) == 0 {
+		paths = []string{"/"}
+	}
+	for _, p := range paths {
+		var size, files, dirs int64
+		err := walk(ctx, c, dirPath(p), 0, func(info *client.Info, depth int) error {
+			if info.IsDir {
+				dirs++
+				return nil
+			}
+			if info.Size < 0 {
+				var err error
+				if info, err = c.Stat(ctx, info.Path); err != nil {
+					return err
+				}
+			}
+			files++
+			size += info.Size
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		fmt.Printf("%d bytes\t%d files\t%d directories\t%s\n", size, files, dirs, dirPath(p))
+	}
+	return nil
+}
+
+func tree(ctx context.Context, c *client.Client, args []string) error {
+	fs := newFlagSet("tree")
+	fs.Parse(args)
+	paths := fs.Args()
+	if len(paths) == 0 {
+		paths = []string{"/"}
+	}
+	for _, p := range paths {
+		var files, dirs int
+		fmt.Println(dirPath(p))
+		err := walk(ctx, c, dirPath(p), 1, func(info *client.Info, depth int) error {
+			name := path.Base(info.Path)
+			if info.IsDir {
+				dirs++
+				name += "/"
+			} else {
+				files++
+			}
+			fmt.Printf("%s%s\n", strings.Repeat("  ", depth), name)
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		fmt.Printf("%d directories, %d files\n", dirs, files)
+	}
+	return nil
+}
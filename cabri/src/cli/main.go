@@ -0,0 +1,82 @@
+package main
+
+import (
+	"cabri/client"
+	"context"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"os/signal"
+	"sort"
+	"syscall"
+
+	"github.com/sirupsen/logrus"
+)
+
+type command struct {
+	usage string
+	run   func(ctx context.Context, c *client.Client, args []string) error
+}
+
+var commands map[string]command
+
+func init() {
+	commands = map[string]command{
+		"ls":    {"ls [-l] PATH...", ls},
+		"stat":  {"stat PATH...", stat},
+		"get":   {"get [-r] REMOTE_PATH LOCAL_PATH", get},
+		"put":   {"put [-r] LOCAL_PATH REMOTE_PATH", put},
+		"mkdir": {"mkdir PATH...", mkdir},
+		"rm":    {"rm [-r] PATH...", rm},
+		"cp":    {"cp [-r] [-target-url URL] SOURCE_PATH TARGET_PATH", cp},
+		"du":    {"du PATH...", du},
+		"tree":  {"tree PATH...", tree},
+	}
+}
+
+func usage() {
+	out := flag.CommandLine.Output()
+	fmt.Fprintf(out, "Usage of cabri: cabri [flags] command [command flags] arguments\n")
+	flag.PrintDefaults()
+	fmt.Fprintf(out, "Commands:\n")
+	names := make([]string, 0, len(commands))
+	for name := range commands {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		fmt.Fprintf(out, "  %s\n", commands[name].usage)
+	}
+}
+
+func main() {
+	var fDebug = flag.Bool("debug", false, "Displays debug messages")
+	var baseUrl = flag.String("url", os.Getenv("CABRI_URL"), "Base URL of the remote paths, defaults to the CABRI_URL environment variable")
+	flag.Usage = usage
+	flag.Parse()
+	if *baseUrl == "" {
+		log.Fatalf("Empty url, please read the documentation")
+	}
+	if flag.NArg() < 1 {
+		usage()
+		os.Exit(1)
+	}
+	cmd, ok := commands[flag.Arg(0)]
+	if !ok {
+		log.Fatalf("Unknown command %s, please read the documentation", flag.Arg(0))
+	}
+	if *fDebug {
+		logrus.SetLevel(logrus.DebugLevel)
+	} else {
+		logrus.SetLevel(logrus.InfoLevel)
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
+	if err := cmd.run(ctx, client.New(*baseUrl, nil), flag.Args()[1:]); err != nil {
+		fmt.Fprintf(os.Stderr, "cabri %s: %v\n", flag.Arg(0), err)
+		stop()
+		os.Exit(1)
+	}
+}
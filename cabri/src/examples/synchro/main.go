@@ -1,343 +1,251 @@
 package main
 
 import (
-	"bufio"
+	"cabri/synchro"
+	"cabri/tracing"
+	"context"
+	"encoding/json"
 	"flag"
-	"fmt"
-	"io"
 	"io/ioutil"
 	"log"
-	"net/http"
 	"os"
-	"strings"
-	"sync"
 	"time"
 
 	"github.com/sirupsen/logrus"
 )
 
-var debug = false
-var mu sync.Mutex
-var currentDirs = make(map[string]bool)
-var currentContents = make(map[string]bool)
-var maxOutstanding = 5
-var entries = []string{}
-
-func usage() {
-	log.Fatalf("Incorrect flags please read the documentation")
-}
+const (
+	exitSuccess        = 0
+	exitPartialFailure = 2
+	exitTotalFailure   = 3
+)
 
-func main() {
-	var fDebug = flag.Bool("debug", false, "Displays debug messages and run gin in debug mode")
-	var sourceUrl = flag.String("source-url", "", "Source URL")
-	var targetUrl = flag.String("target-url", "", "Target URL")
-	var maxWait = flag.Int("max-wait", 600, "Time to wait before exiting in 1/10s, defaults to 0.6s")
-	flag.Parse()
-	if *sourceUrl == "" {
-		log.Fatalf("Empty source-url, please read the documentation")
-	}
-	if *sourceUrl == "" {
-		log.Fatalf("Empty target-url, please read the documentation")
-	}
+var filterRules []synchro.FilterRule
 
-	debug = *fDebug
-	if debug {
-		logrus.SetLevel(logrus.DebugLevel)
-	} else {
-		logrus.SetLevel(logrus.InfoLevel)
-	}
-	logrus.Info("synchro: main: started")
-	logrus.Debug("synchro: main: see if we are in debug mode")
-	runSynchro(*sourceUrl, *targetUrl, *maxWait)
-	return
+// filterFlag appends the rules in the order of the command line
+type filterFlag struct {
+	include bool
 }
 
-func setCurrent(dir string, content string) {
-	mu.Lock()
-	defer mu.Unlock()
-	if dir != "" {
-		currentDirs[dir] = true
-	} else {
-		currentContents[content] = true
-	}
+func (f filterFlag) String() string {
+	return ""
 }
 
-func clearCurrent(dir string, content string) {
-	mu.Lock()
-	defer mu.Unlock()
-	if dir != "" {
-		delete(currentDirs, dir)
-	} else {
-		delete(currentContents, content)
+func (f filterFlag) Set(pattern string) error {
+	rule, err := synchro.NewFilterRule(f.include, pattern)
+	if err != nil {
+		return err
 	}
+	filterRules = append(filterRules, rule)
+	return nil
 }
 
-func getCurrentDir(dir string) bool {
-	mu.Lock()
-	defer mu.Unlock()
-	return currentDirs[dir]
-}
+type filterFileFlag struct{}
 
-func pushEntry(id string, newEntries []string) {
-	logrus.Debugf("pushEntry %s: %d <- %d", id, len(entries), len(newEntries))
-	mu.Lock()
-	defer mu.Unlock()
-	for _, entry := range newEntries {
-		entries = append(entries, entry)
-	}
+func (f filterFileFlag) String() string {
+	return ""
 }
 
-func pullEntry(id string) (entry string) {
-	logrus.Debugf("pullEntry %s: %d", id, len(entries))
-	mu.Lock()
-	defer mu.Unlock()
-	if len(entries) == 0 {
-		return
+func (f filterFileFlag) Set(fileName string) error {
+	rules, err := synchro.ReadFilterFile(fileName)
+	if err != nil {
+		return err
 	}
-	entry = entries[0]
-	entries = entries[1:len(entries)]
-	logrus.Debugf("pullEntry %s: %d -> %s", id, len(entries), entry)
-	return
+	filterRules = append(filterRules, rules...)
+	return nil
 }
 
-func runSynchro(sourceUrl string, targetUrl string, maxWait int) {
-	currentChan := make(chan string)
-
-	logrus.Debugf("runSynchro %s %s", sourceUrl, targetUrl)
-
-	for i := 0; i < maxOutstanding; i++ {
-		ecId := fmt.Sprintf("EC#%d", i)
-		go entryConsumer(ecId, sourceUrl, targetUrl, currentChan)
-	}
-
-	id := "RSYN"
-	pushEntry(id, []string{"/"})
-
-	for {
-		path := ""
-		count := 0
-		for {
-			path = pullEntry(id)
-			if path != "" {
-				break
-			}
-			time.Sleep(100 * time.Millisecond)
-			count += 1
-			if count == maxWait {
-				break
-			}
-		}
-		if count >= maxWait {
-			break
-		}
-
-		if path[len(path)-1] == '/' {
-			setCurrent(path, "")
-		}
-		logrus.Debugf("runSynchro currentChan <- %s", path)
-		currentChan <- path
-	}
-	logrus.Debugf("runSynchro %s %s exiting", sourceUrl, targetUrl)
+type report struct {
+	synchro.Report
+	ExitCode int `json:"exit_code"`
 }
 
-func entryConsumer(id string, sourceUrl string, targetUrl string, currentChan chan string) {
-	for {
-		path := <-currentChan
-		logrus.Debugf("entryConsumer%s %s", id, path)
-		if path[len(path)-1] == '/' {
-			setCurrent(path, "")
-			defer clearCurrent(path, "")
-			waitForParentDir(path)
-			entries := synchroDir(id, sourceUrl, targetUrl, path)
-			clearCurrent(path, "")
-			pushEntry(id, entries)
-		} else {
-			setCurrent("", path)
-			defer clearCurrent("", path)
-			waitForParentDir(path)
-			synchroContent(id, sourceUrl, targetUrl, path)
-		}
+func exitCode(r synchro.Report) int {
+	switch r.Outcome {
+	case synchro.OutcomeTotalFailure:
+		return exitTotalFailure
+	case synchro.OutcomePartialFailure:
+		return exitPartialFailure
 	}
+	return exitSuccess
 }
 
-func urlPrefix(url string) string {
-	pe := strings.Split(url, "/") // http://dxpydk:8080/s3mcab/test-bk-01
-	return pe[len(pe)-1]
+func logReport(r report) {
+	if r.Verified+r.Missing+r.Extra+r.Divergent > 0 {
+		logrus.Infof("synchro: verified %d, missing %d, extra %d, divergent %d",
+			r.Verified, r.Missing, r.Extra, r.Divergent)
+	}
+	logrus.Infof("synchro: dirs listed %d created %d failed %d, files copied %d skipped %d failed %d, deleted %d failed %d aborted %v, conflicts %d",
+		r.DirsListed, r.DirsCreated, r.DirsFailed, r.FilesCopied, r.FilesSkipped, r.FilesFailed, r.Deleted, r.DeletesFailed, r.DeleteAborted, r.Conflicts)
+	logrus.Infof("synchro: %d bytes transferred in %.3fs, %.0f bytes/s, %d files patched saving %d bytes, exit code %d",
+		r.BytesTransferred, r.Duration, r.Throughput, r.FilesPatched, r.BytesSaved, r.ExitCode)
 }
 
-func waitForParentDir(path string) {
-	if path == "/" {
-		return
-	}
-	pe := strings.Split(path, "/")
-	if pe[len(pe)-1] == "" {
-		pe = pe[0 : len(pe)-1]
-	}
-	parent := strings.Join(pe[0:len(pe)-1], "/") + "/"
-	logrus.Debugf("waitForParentDir %s -> %s parent in queue %v", path, parent, getCurrentDir(parent))
-	for getCurrentDir(parent) {
-		time.Sleep(time.Second)
-		logrus.Debugf("waitForParentDir %s -> %s parent in queue %v", path, parent, getCurrentDir(parent))
+func writeReport(r report, fileName string) error {
+	content, err := json.MarshalIndent(r, "", "  ")
+	if err != nil {
+		return err
 	}
+	return ioutil.WriteFile(fileName, append(content, '\n'), 0666)
 }
 
-func synchroDir(id string, sourceUrl string, targetUrl string, path string) (entries []string) {
-	var req *http.Request
-	var resp *http.Response
-	var err error
-	var exists bool
-
-	logrus.Debugf("synchroDir %s", path)
-
-	statUrl := fmt.Sprintf("%s%s", targetUrl, path)
-	resp, err = http.Head(statUrl)
-	if err != nil {
-		log.Printf("synchroDir: head: %s error %v", path, err)
-		return
+func main() {
+	defaults := synchro.DefaultOptions()
+	var fDebug = flag.Bool("debug", false, "Displays debug messages")
+	var sourceUrl = flag.String("source-url", "", "Source URL")
+	var targetUrl = flag.String("target-url", "", "Target URL")
+	var fDelete = flag.Bool("delete", false, "Deletes target entries absent from the source")
+	var fMaxDelete = flag.Int("max-delete", defaults.MaxDelete, "Aborts deletion if more entries would be deleted, negative for no limit")
+	var fDeltaMinSize = flag.String("delta-min-size", "1M", "Minimum size of the target files updated by sending only the differences, 0 to disable")
+	var fDryRun = flag.Bool("dry-run", false, "Prints the plan of the synchronization without modifying the target")
+	var fPlanFormat = flag.String("plan-format", "text", "The format of the dry-run plan: text or json")
+	var fRetries = flag.Int("retries", defaults.Retries, "Maximum attempts for each operation")
+	var fRetryBase = flag.Duration("retry-base", defaults.RetryBase, "Base delay before retrying an operation, doubled at each attempt")
+	var fRetryMax = flag.Duration("retry-max", defaults.RetryMax, "Maximum delay before retrying an operation")
+	var fRequeue = flag.Int("requeue", defaults.Requeue, "Times an entry is re-queued after its operations failed")
+	flag.Var(filterFlag{include: true}, "include", "Includes entries matching the glob pattern, repeatable")
+	flag.Var(filterFlag{include: false}, "exclude", "Excludes entries matching the glob pattern, repeatable")
+	flag.Var(filterFileFlag{}, "filter-file", "Reads include (+ pattern) and exclude (- pattern) rules from a file")
+	var fListWorkers = flag.Int("list-workers", defaults.ListWorkers, "Number of workers listing directories")
+	var fTransferWorkers = flag.Int("transfer-workers", defaults.TransferWorkers, "Number of workers comparing and copying files")
+	var fBwLimit = flag.String("bwlimit", "0", "Bytes per second shared by all transfers, with an optional K, M or G suffix, 0 for unlimited")
+	var fState = flag.String("state", "", "State database file recording the synchronized contents, to skip the unchanged ones")
+	var fCheckpoint = flag.String("checkpoint", "", "File receiving the progress of the run periodically and when interrupted")
+	var fCheckpointInterval = flag.Duration("checkpoint-interval", defaults.CheckpointInterval, "The delay between two checkpoints")
+	var fResume = flag.Bool("resume", false, "Continues the run interrupted according to the checkpoint file")
+	var fFull = flag.Bool("full", false, "Verifies all the contents, ignoring the state database")
+	var fBidirectional = flag.Bool("bidirectional", false, "Propagates the changes of each side to the other, requires a state database")
+	var fCompare = flag.String("compare", string(defaults.Compare), "How unchanged files are skipped: checksum, size+mtime, size-only or always")
+	var fConflict = flag.String("conflict", string(defaults.ConflictPolicy), "The bidirectional conflict policy: newer, source or keep-both")
+	var fVerify = flag.Bool("verify", false, "Compares the source and the target without modifying them, reporting the differences")
+	var fWatch = flag.Bool("watch", false, "Keeps running, synchronizing after each interval, on SIGHUP or on a POST to /sync")
+	var fInterval = flag.Duration("interval", 5*time.Minute, "The delay between the end of a synchronization and the next one with watch")
+	var fFollowChanges = flag.Bool("follow-changes", false, "Also synchronizes with watch when the source server journal notifies changes")
+	var fStatusAddr = flag.String("status-addr", "", "The host:port serving /status, /metrics and /sync, disabled if empty")
+	var fMaxWait = flag.Int("max-wait", 0, "Deprecated and ignored, the client exits once all the work is done")
+	var fReport = flag.String("report", "", "File receiving the JSON summary of the run")
+	var traceExporter = flag.String("trace-exporter", "none", "The OpenTelemetry trace exporter: none, otlp or file")
+	var traceFile = flag.String("trace-file", "", "The file receiving spans with the file trace exporter")
+	flag.Parse()
+	if *sourceUrl == "" {
+		log.Fatalf("Empty source-url, please read the documentation")
 	}
-	defer resp.Body.Close()
-	if resp.StatusCode == http.StatusOK {
-		logrus.Debugf("synchroDir%s %s exists", id, path)
-		exists = true
+	if *targetUrl == "" {
+		log.Fatalf("Empty target-url, please read the documentation")
 	}
 
-	if !exists {
-		client := &http.Client{}
-		putUrl := fmt.Sprintf("%s%s?recursive", targetUrl, path)
-		req, err = http.NewRequest(http.MethodPut, putUrl, strings.NewReader(""))
-		if err != nil {
-			log.Printf("synchroDir: put: %s error %v", path, err)
-			return
-		}
-		logrus.Debugf("synchroDir%s %s DO %v", id, path, req)
-
-		resp, err = client.Do(req)
-		if err != nil {
-			log.Printf("synchroDir: put: %s error %v", path, err)
-			return
-		}
-		defer resp.Body.Close()
-		if resp.StatusCode != http.StatusOK {
-			log.Printf("synchroDir: put: %s error %v", path, fmt.Errorf("status %d", resp.StatusCode))
-			return
-		}
-		log.Printf("mkdir %s", path)
+	if *fPlanFormat != "text" && *fPlanFormat != "json" {
+		log.Fatalf("Incorrect plan-format flag, please read the documentation")
 	}
-
-	getUrl := fmt.Sprintf("%s%s", sourceUrl, path)
-	resp, err = http.Get(getUrl)
-	if err != nil {
-		log.Printf("synchroDir: get: %s error %v", path, err)
-		return
+	if *fWatch && (*fDryRun || *fInterval <= 0) {
+		log.Fatalf("Incorrect watch flags, please read the documentation")
 	}
-	defer resp.Body.Close()
-	if resp.StatusCode != http.StatusOK {
-		log.Printf("synchroDir: get: %s error %v", path, fmt.Errorf("status %d", resp.StatusCode))
-		return
+	if *fVerify && (*fDryRun || *fDelete || *fBidirectional) {
+		log.Fatalf("Incorrect verify flags, please read the documentation")
 	}
-	rd := bufio.NewReader(resp.Body)
-	for {
-		line, err := rd.ReadString('\n')
-		logrus.Debugf("synchroDir%s ReadString line %s err %s", id, line, err)
-
-		if err == io.EOF || line == "\n" {
-			break
-		}
-		if err != nil {
-			log.Printf("synchroDir: read: %s error %v", path, err)
-			return
-		}
-		logrus.Debugf("synchroDir%s ReadString entries append %s (%s)", id, line[len(urlPrefix(sourceUrl))+1:len(line)-1], urlPrefix(sourceUrl))
-		entries = append(entries, line[len(urlPrefix(sourceUrl))+1:len(line)-1])
+	if *fListWorkers < 1 || *fTransferWorkers < 1 {
+		log.Fatalf("Incorrect list-workers or transfer-workers flag, please read the documentation")
 	}
-	return
-}
-
-func synchroContent(id string, sourceUrl string, targetUrl string, path string) {
-	var req *http.Request
-	var resp *http.Response
-	var err error
-	var targetCs string
-
-	logrus.Debugf("synchroContent%s %s", id, path)
-
-	statUrl := fmt.Sprintf("%s%s", targetUrl, path)
-	resp, err = http.Head(statUrl)
+	bwLimit, err := synchro.ParseBytes(*fBwLimit)
 	if err != nil {
-		log.Printf("synchroContent: head target: %s error %v", path, err)
-		return
+		log.Fatalf("Incorrect bwlimit flag, please read the documentation")
 	}
-	defer resp.Body.Close()
-	if resp.StatusCode == http.StatusOK {
-		targetCs = resp.Header.Get("Checksum")
-		logrus.Debugf("synchroContent%s %s exists Checksum %s", id, path, targetCs)
+	deltaMinSize, err := synchro.ParseBytes(*fDeltaMinSize)
+	if err != nil {
+		log.Fatalf("Incorrect delta-min-size flag, please read the documentation")
 	}
 
-	if targetCs != "" {
-		statUrl := fmt.Sprintf("%s%s", sourceUrl, path)
-		resp, err = http.Head(statUrl)
-		if err != nil {
-			log.Printf("synchroContent: head source: %s error %v", path, err)
-			return
-		}
-		defer resp.Body.Close()
-		if resp.StatusCode == http.StatusOK {
-			if resp.Header.Get("Checksum") == targetCs {
-				logrus.Debugf("synchroContent%s %s exists with same Checksum %s", id, path, targetCs)
-				return
-			}
-		}
+	if *fDebug {
+		logrus.SetLevel(logrus.DebugLevel)
+	} else {
+		logrus.SetLevel(logrus.InfoLevel)
 	}
-
-	getUrl := fmt.Sprintf("%s%s", sourceUrl, path)
-	resp, err = http.Get(getUrl)
+	logrus.Info("synchro: main: started")
+	if isFlagSet("max-wait") {
+		logrus.Warnf("synchro: main: -max-wait %d is deprecated and ignored", *fMaxWait)
+	}
+	logrus.Debug("synchro: main: see if we are in debug mode")
+	shutdownTracing, err := tracing.Init(context.Background(), tracing.Options{
+		ServiceName: "cabri-synchro-client",
+		Exporter:    *traceExporter,
+		FileName:    *traceFile,
+	})
 	if err != nil {
-		log.Printf("synchroContent: get: %s error %v", path, err)
-		return
+		log.Fatalf("Cannot initialize tracing: %v", err)
+	}
+
+	options := defaults
+	options.SourceUrl = *sourceUrl
+	options.TargetUrl = *targetUrl
+	options.ListWorkers = *fListWorkers
+	options.TransferWorkers = *fTransferWorkers
+	options.BandwidthLimit = bwLimit
+	options.Delete = *fDelete
+	options.MaxDelete = *fMaxDelete
+	options.DryRun = *fDryRun
+	options.Retries = *fRetries
+	options.RetryBase = *fRetryBase
+	options.RetryMax = *fRetryMax
+	options.Requeue = *fRequeue
+	options.Filters = filterRules
+	options.Full = *fFull
+	options.Bidirectional = *fBidirectional
+	options.Verify = *fVerify
+	options.Compare = synchro.CompareMode(*fCompare)
+	options.ConflictPolicy = synchro.ConflictPolicy(*fConflict)
+	options.DeltaMinSize = deltaMinSize
+	options.Checkpoint = *fCheckpoint
+	options.CheckpointInterval = *fCheckpointInterval
+	options.Resume = *fResume
+	if *fState != "" {
+		if options.State, err = synchro.OpenState(*fState); err != nil {
+			log.Fatalf("Cannot open the state database: %v", err)
+		}
 	}
-	defer resp.Body.Close()
-	if resp.StatusCode != http.StatusOK {
-		log.Printf("synchroContent: get: %s error %v", path, fmt.Errorf("status %d", resp.StatusCode))
-		return
+	syncer, err := synchro.New(options)
+	if err != nil {
+		log.Fatalf("Cannot create the synchronization: %v", err)
 	}
 
-	var tmpfileW *os.File
-	if tmpfileW, err = ioutil.TempFile("", "cabri*"); err != nil {
-		log.Printf("synchroContent: TempFile: %s error %v", path, err)
-		return
-	}
-	defer os.Remove(tmpfileW.Name())
-	defer tmpfileW.Close()
-	if _, err = io.Copy(tmpfileW, resp.Body); err != nil {
-		log.Printf("synchroContent: Copy: %s error %v", path, err)
-		return
+	ctx, cancel := context.WithCancel(context.Background())
+	d := newDaemon(syncer, *fInterval, *fReport)
+	go d.handleSignals(cancel)
+	if *fStatusAddr != "" {
+		go d.serveStatus(*fStatusAddr)
 	}
-	tmpfileW.Close()
-	var tmpfileR *os.File
-	if tmpfileR, err = os.Open(tmpfileW.Name()); err != nil {
-		log.Printf("synchroContent: open TempFile: %s error %v", path, err)
+	var exitStatus int
+	if *fWatch {
+		if *fFollowChanges {
+			go d.followChanges(ctx, *sourceUrl)
+		}
+		d.watch(ctx)
+		exitStatus = d.lastExitCode()
+	} else {
+		exitStatus = d.runOnce(ctx).ExitCode
 	}
-	defer tmpfileR.Close()
-
-	client := &http.Client{}
-	putUrl := fmt.Sprintf("%s%s", targetUrl, path)
-	req, err = http.NewRequest(http.MethodPut, putUrl, tmpfileR)
-	if err != nil {
-		log.Printf("synchroContent: put: %s error %v", path, err)
-		return
+	cancel()
+	if options.State != nil {
+		if err = options.State.Close(); err != nil {
+			logrus.Errorf("synchro: main: closing state: %v", err)
+		}
 	}
-	req.Header.Add("Last-Modified", resp.Header.Get("Last-Modified"))
-	logrus.Debugf("synchroContent%s %s DO %v", id, path, req)
-
-	resp, err = client.Do(req)
-	if err != nil {
-		log.Printf("synchroContent: put: %s error %v", path, err)
-		return
+	if *fDryRun {
+		if err = synchro.WritePlan(os.Stdout, syncer.Plan(), *fPlanFormat); err != nil {
+			logrus.Errorf("synchro: main: printing plan: %v", err)
+		}
 	}
-	defer resp.Body.Close()
-	if resp.StatusCode != http.StatusOK {
-		log.Printf("synchroContent: put: %s error %v", path, fmt.Errorf("status %d", resp.StatusCode))
-		return
+	if err = shutdownTracing(context.Background()); err != nil {
+		logrus.Errorf("synchro: main: flushing traces: %v", err)
 	}
-	log.Printf("put content %s", path)
+	os.Exit(exitStatus)
+}
+
+func isFlagSet(name string) bool {
+	set := false
+	flag.Visit(func(f *flag.Flag) {
+		if f.Name == name {
+			set = true
+		}
+	})
+	return set
 }
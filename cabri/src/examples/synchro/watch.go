@@ -0,0 +1,255 @@
+package main
+
+import (
+	"cabri/client"
+	"cabri/synchro"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// daemon runs the synchronization once or repeatedly on an interval or when triggered,
+// keeping the status and the cumulative counters of the runs
+type daemon struct {
+	syncer     *synchro.Syncer
+	interval   time.Duration
+	reportFile string
+	trigger    chan struct{}
+	stopping   chan struct{}
+	mu         sync.Mutex
+	running    bool
+	runs       int64
+	nextRun    time.Time
+	last       *report
+	totals     synchro.Report
+}
+
+func newDaemon(syncer *synchro.Syncer, interval time.Duration, reportFile string) *daemon {
+	return &daemon{
+		syncer:     syncer,
+		interval:   interval,
+		reportFile: reportFile,
+		trigger:    make(chan struct{}, 1),
+		stopping:   make(chan struct{}),
+	}
+}
+
+func (d *daemon) triggerRun() {
+	select {
+	case d.trigger <- struct{}{}:
+	default:
+	}
+}
+
+// handleSignals triggers a run on SIGHUP, lets the transfers in progress finish
+// on a first SIGINT or SIGTERM and cancels them on the second one
+func (d *daemon) handleSignals(cancel context.CancelFunc) {
+	sigs := make(chan os.Signal, 2)
+	signal.Notify(sigs, syscall.SIGINT, syscall.SIGTERM, syscall.SIGHUP)
+	stopping := false
+	for sig := range sigs {
+		switch {
+		case sig == syscall.SIGHUP:
+			logrus.Infof("synchro: %v, synchronizing", sig)
+			d.triggerRun()
+		case !stopping:
+			stopping = true
+			logrus.Infof("synchro: %v, finishing the transfers in progress", sig)
+			d.syncer.Stop()
+			close(d.stopping)
+		default:
+			logrus.Infof("synchro: %v, canceling the transfers in progress", sig)
+			cancel()
+		}
+	}
+}
+
+func (d *daemon) runOnce(ctx context.Context) report {
+	d.mu.Lock()
+	d.running = true
+	d.mu.Unlock()
+
+	r := report{Report: d.syncer.Run(ctx)}
+	r.ExitCode = exitCode(r.Report)
+	logReport(r)
+	if d.reportFile != "" {
+		if err := writeReport(r, d.reportFile); err != nil {
+			logrus.Errorf("synchro: main: writing report: %v", err)
+		}
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.running = false
+	d.runs++
+	d.last = &r
+	d.totals.DirsListed += r.DirsListed
+	d.totals.DirsCreated += r.DirsCreated
+	d.totals.DirsFailed += r.DirsFailed
+	d.totals.FilesCopied += r.FilesCopied
+	d.totals.FilesSkipped += r.FilesSkipped
+	d.totals.FilesFailed += r.FilesFailed
+	d.totals.Deleted += r.Deleted
+	d.totals.DeletesFailed += r.DeletesFailed
+	d.totals.Conflicts += r.Conflicts
+	d.totals.BytesTransferred += r.BytesTransferred
+	d.totals.FilesPatched += r.FilesPatched
+	d.totals.BytesSaved += r.BytesSaved
+	d.totals.Verified += r.Verified
+	d.totals.Missing += r.Missing
+	d.totals.Extra += r.Extra
+	d.totals.Divergent += r.Divergent
+	return r
+}
+
+func (d *daemon) lastExitCode() int {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.last == nil {
+		return exitSuccess
+	}
+	return d.last.ExitCode
+}
+
+// watch runs the synchronization until stopped,
+// after each interval or as soon as a run is triggered
+func (d *daemon) watch(ctx context.Context) {
+	for {
+		d.runOnce(ctx)
+		d.mu.Lock()
+		d.nextRun = time.Now().Add(d.interval)
+		d.mu.Unlock()
+		select {
+		case <-d.stopping:
+			return
+		case <-ctx.Done():
+			return
+		case <-time.After(d.interval):
+		case <-d.trigger:
+		}
+	}
+}
+
+// followChanges triggers a run when the journal of the server of sourceUrl notifies changes under it
+func (d *daemon) followChanges(ctx context.Context, sourceUrl string) {
+	cli := client.New(sourceUrl, nil)
+	var cursor string
+	for {
+		changes, next, err := cli.Changes(ctx, cursor, time.Minute)
+		switch {
+		case errors.Is(err, client.ErrGone):
+			logrus.Infof("synchro: changes: %v, synchronizing", err)
+			cursor = next
+			d.triggerRun()
+			continue
+		case errors.Is(err, client.ErrNotFound):
+			logrus.Warnf("synchro: changes: the source server has no change journal")
+			return
+		case err != nil:
+			if ctx.Err() != nil {
+				return
+			}
+			logrus.Warnf("synchro: changes: %v", err)
+			select {
+			case <-time.After(10 * time.Second):
+				continue
+			case <-d.stopping:
+				return
+			case <-ctx.Done():
+				return
+			}
+		}
+		if len(changes) > 0 && cursor != "" {
+			logrus.Debugf("synchro: changes: %d changes from %s, synchronizing", len(changes), changes[0].Path)
+			d.triggerRun()
+		}
+		cursor = next
+		select {
+		case <-d.stopping:
+			return
+		default:
+		}
+	}
+}
+
+func (d *daemon) status(w http.ResponseWriter, r *http.Request) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	status := struct {
+		Running bool      `json:"running"`
+		Runs    int64     `json:"runs"`
+		NextRun time.Time `json:"next_run"`
+		Last    *report   `json:"last_report"`
+	}{d.running, d.runs, d.nextRun, d.last}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(status)
+}
+
+// metrics exposes the counters in the Prometheus text format
+func (d *daemon) metrics(w http.ResponseWriter, r *http.Request) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	running := 0
+	if d.running {
+		running = 1
+	}
+	fmt.Fprintf(w, "# TYPE cabri_synchro_running gauge\ncabri_synchro_running %d\n", running)
+	fmt.Fprintf(w, "# TYPE cabri_synchro_runs_total counter\ncabri_synchro_runs_total %d\n", d.runs)
+	for _, counter := range []struct {
+		name  string
+		value int64
+	}{
+		{"dirs_listed", d.totals.DirsListed},
+		{"dirs_created", d.totals.DirsCreated},
+		{"dirs_failed", d.totals.DirsFailed},
+		{"files_copied", d.totals.FilesCopied},
+		{"files_skipped", d.totals.FilesSkipped},
+		{"files_failed", d.totals.FilesFailed},
+		{"deleted", d.totals.Deleted},
+		{"deletes_failed", d.totals.DeletesFailed},
+		{"conflicts", d.totals.Conflicts},
+		{"bytes_transferred", d.totals.BytesTransferred},
+		{"files_patched", d.totals.FilesPatched},
+		{"bytes_saved", d.totals.BytesSaved},
+		{"verified", d.totals.Verified},
+		{"missing", d.totals.Missing},
+		{"extra", d.totals.Extra},
+		{"divergent", d.totals.Divergent},
+	} {
+		fmt.Fprintf(w, "# TYPE cabri_synchro_%s_total counter\ncabri_synchro_%s_total %d\n", counter.name, counter.name, counter.value)
+	}
+	if d.last != nil {
+		fmt.Fprintf(w, "# TYPE cabri_synchro_last_run_timestamp_seconds gauge\ncabri_synchro_last_run_timestamp_seconds %d\n", d.last.End.Unix())
+		fmt.Fprintf(w, "# TYPE cabri_synchro_last_run_duration_seconds gauge\ncabri_synchro_last_run_duration_seconds %g\n", d.last.Duration)
+		fmt.Fprintf(w, "# TYPE cabri_synchro_last_run_exit_code gauge\ncabri_synchro_last_run_exit_code %d\n", d.last.ExitCode)
+	}
+}
+
+func (d *daemon) sync(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "use POST", http.StatusMethodNotAllowed)
+		return
+	}
+	d.triggerRun()
+	w.WriteHeader(http.StatusAccepted)
+}
+
+func (d *daemon) serveStatus(addr string) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/status", d.status)
+	mux.HandleFunc("/metrics", d.metrics)
+	mux.HandleFunc("/sync", d.sync)
+	if err := http.ListenAndServe(addr, mux); err != nil {
+		logrus.Errorf("synchro: status endpoint: %v", err)
+	}
+}
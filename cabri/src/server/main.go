@@ -2,11 +2,18 @@ package main
 
 import (
 	"cabri"
+	"cabri/tracing"
+	"context"
+	"errors"
 	"flag"
 	"log"
+	"os"
+	"strings"
+	"time"
 
 	"github.com/gin-gonic/gin"
 	"github.com/sirupsen/logrus"
+	"go.opentelemetry.io/contrib/instrumentation/github.com/gin-gonic/gin/otelgin"
 )
 
 var debug = true
@@ -21,6 +28,25 @@ func main() {
 	var configName = flag.String("config", "", "The configuration name: S3Read or FSWrite")
 	var rootUrl = flag.String("root-url", "", "Root for the URL")
 	var rootDir = flag.String("root-dir", "", "Root directory if filesystem")
+	var readyBuckets = flag.String("ready-buckets", "", "Comma separated list of buckets checked by /readyz if S3")
+	var logFormat = flag.String("log-format", "text", "The log output format: text or json")
+	var auditFile = flag.String("audit-file", "", "Audit log file recording mutating operations, disabled if empty")
+	var auditMaxSize = flag.Int("audit-max-size", 100, "Size in megabytes of the audit log file before it gets rotated")
+	var auditMaxBackups = flag.Int("audit-max-backups", 10, "Number of rotated audit log files to retain, 0 to retain all")
+	var auditMaxAge = flag.Int("audit-max-age", 0, "Number of days to retain rotated audit log files, 0 to retain all")
+	var traceExporter = flag.String("trace-exporter", "none", "The OpenTelemetry trace exporter: none, otlp or file")
+	var traceFile = flag.String("trace-file", "", "The file receiving spans with the file trace exporter")
+	var clientRate = flag.Float64("client-rate", 0, "Requests per second allowed for each client, 0 for unlimited")
+	var clientBurst = flag.Int("client-burst", 0, "Requests burst allowed for each client, defaults to client-rate")
+	var clientMaxConcurrent = flag.Int("client-max-concurrent", 0, "Concurrent requests allowed for each client, 0 for unlimited")
+	var mountRate = flag.Float64("mount-rate", 0, "Requests per second allowed for each mount, 0 for unlimited")
+	var mountBurst = flag.Int("mount-burst", 0, "Requests burst allowed for each mount, defaults to mount-rate")
+	var mountMaxConcurrent = flag.Int("mount-max-concurrent", 0, "Concurrent requests allowed for each mount, 0 for unlimited")
+	var maxChecksums = flag.Int("max-checksums", 0, "Concurrent checksum computations, 0 for unlimited")
+	var journalSize = flag.Int("journal-size", 10000, "Number of changes kept for GET /changes, 0 to disable the change journal")
+	var journalFSNotify = flag.Bool("journal-fsnotify", true, "Also records the changes made to the root-dir without cabri if filesystem")
+	var trustedProxies = flag.String("trusted-proxies", "", "Comma separated list of the IP addresses or CIDR ranges of the reverse proxies trusted for the client IP and user headers")
+	var shutdownTimeout = flag.Duration("shutdown-timeout", 30*time.Second, "Time to wait for in-flight requests on SIGINT or SIGTERM")
 	flag.Parse()
 	if *addr == "" {
 		log.Fatalf("Empty addr, please read the documentation")
@@ -35,6 +61,10 @@ func main() {
 		log.Fatalf("Empty root-dir flag for filesystem, please read the documentation")
 	}
 
+	if err := cabri.SetLogFormat(*logFormat); err != nil {
+		log.Fatalf("Incorrect log-format flag, please read the documentation")
+	}
+
 	debug = *fDebug
 	if debug {
 		gin.SetMode(gin.DebugMode)
@@ -45,8 +75,63 @@ func main() {
 	}
 	logrus.Info("main: started")
 	logrus.Debug("main: see if we are in debug mode")
+	if *auditFile != "" {
+		cabri.InitAudit(cabri.AuditOptions{
+			FileName:   *auditFile,
+			MaxSize:    *auditMaxSize,
+			MaxBackups: *auditMaxBackups,
+			MaxAge:     *auditMaxAge,
+		})
+	}
+	shutdownTracing, err := tracing.Init(context.Background(), tracing.Options{
+		ServiceName: "cabri-server",
+		Exporter:    *traceExporter,
+		FileName:    *traceFile,
+	})
+	if err != nil {
+		log.Fatalf("Cannot initialize tracing: %v", err)
+	}
 	engine := gin.New()
-	engine.Use(gin.Logger(), gin.Recovery())
-	cabri.Run(engine, *addr, *configName, *rootUrl, *rootDir)
+	engine.Use(otelgin.Middleware("cabri-server"), cabri.RequestId(), cabri.AccessLogger(), gin.Recovery())
+	var buckets []string
+	if *readyBuckets != "" {
+		buckets = strings.Split(*readyBuckets, ",")
+	}
+	var proxies []string
+	if *trustedProxies != "" {
+		proxies = strings.Split(*trustedProxies, ",")
+	}
+	err = cabri.Run(engine, cabri.RunOptions{
+		Addr:            *addr,
+		ConfigName:      *configName,
+		RscRoot:         *rootUrl,
+		RootDir:         *rootDir,
+		ReadyBuckets:    buckets,
+		ShutdownTimeout: *shutdownTimeout,
+		JournalSize:     *journalSize,
+		JournalFSNotify: *journalFSNotify,
+		TrustedProxies:  proxies,
+		Limits: cabri.LimitOptions{
+			ClientRate:          *clientRate,
+			ClientBurst:         *clientBurst,
+			ClientConcurrency:   *clientMaxConcurrent,
+			MountRate:           *mountRate,
+			MountBurst:          *mountBurst,
+			MountConcurrency:    *mountMaxConcurrent,
+			ChecksumConcurrency: *maxChecksums,
+		},
+	})
+	if tErr := shutdownTracing(context.Background()); tErr != nil {
+		logrus.Errorf("main: flushing traces: %v", tErr)
+	}
+	if errors.Is(err, cabri.ErrShutdownTimeout) {
+		logrus.Errorf("main: %v", err)
+		os.Exit(2)
+	}
+	if err != nil {
+		logrus.Errorf("main: %v", err)
+		os.Exit(1)
+	}
+	logrus.Info("main: stopped")
 	return
 }